@@ -0,0 +1,143 @@
+package mailout
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// headerApplicationJSONV2 media type of the version 2 responses. Clients opt in
+// by sending it in the Accept header. Without it the response keeps the
+// version 1 shape of JSONError.
+const headerApplicationJSONV2 = "application/vnd.mailout.v2+json"
+
+// Machine readable error codes of the version 2 responses.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeRateLimited      = "rate_limited"
+	errCodePayloadTooLarge  = "payload_too_large"
+	errCodeUnprocessable    = "unprocessable"
+	errCodeInternal         = "internal_error"
+
+	errCodeIPBlocked            = "ip_blocked"
+	errCodeOriginNotAllowed     = "origin_not_allowed"
+	errCodeCSRFInvalid          = "csrf_invalid"
+	errCodeTimeTrapInvalid      = "timetrap_invalid"
+	errCodePoWInvalid           = "pow_invalid"
+	errCodeCaptchaWrong         = "captcha_wrong"
+	errCodeCaptchaExpired       = "captcha_expired"
+	errCodeCaptchaFailed        = "captcha_failed"
+	errCodeInvalidFields        = "invalid_fields"
+	errCodeInvalidEmail         = "invalid_email"
+	errCodeEmailNotAllowed      = "email_domain_not_allowed"
+	errCodeEmailBlocked         = "email_address_blocked"
+	errCodeEmailDomainBlocked   = "email_domain_blocked"
+	errCodeEmailDisposable      = "email_disposable"
+	errCodeEmailNoRecords       = "email_domain_no_records"
+	errCodeSpam                 = "spam"
+	errCodeCaptchaUnavailable   = "captcha_unavailable"
+	errCodeTooManyFiles         = "too_many_files"
+	errCodeFileTooLarge         = "file_too_large"
+	errCodeFileType             = "file_type_not_allowed"
+	errCodeTooManyFields        = "too_many_fields"
+	errCodeFieldTooLong         = "field_too_long"
+	errCodeIdempotencyKeyReused = "idempotency_key_reused"
+	errCodeVirusFound           = "virus_found"
+	errCodeVirusScanUnavailable = "virus_scan_unavailable"
+)
+
+// JSONErrorV2 the version 2 response. Code 200 and an empty Error specifies a
+// successful request.
+type JSONErrorV2 struct {
+	Version int `json:"version"`
+	// Code represents the HTTP Status Code.
+	Code int `json:"code,omitempty"`
+	// Error human readable message.
+	Error string `json:"error,omitempty"`
+	// ErrorCode machine readable, see the errCode constants.
+	ErrorCode string `json:"error_code,omitempty"`
+	// Fields contains the messages per invalid form field.
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+// codedError an error with a machine readable code.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e codedError) Error() string { return e.msg }
+
+// errorCode returns the code of a codedError or fallback.
+func errorCode(err error, fallback string) string {
+	var ce codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return fallback
+}
+
+// statusErrorCode returns the default error code of an HTTP status code.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusOK:
+		return ""
+	case http.StatusBadRequest:
+		return errCodeBadRequest
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return errCodeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return errCodeRateLimited
+	case http.StatusRequestEntityTooLarge:
+		return errCodePayloadTooLarge
+	case StatusUnprocessableEntity:
+		return errCodeUnprocessable
+	}
+	return errCodeInternal
+}
+
+// captchaErrorCode distinguishes a wrong answer from a captcha which must be
+// reloaded.
+func captchaErrorCode(err error) string {
+	switch err {
+	case errCaptchaWrong:
+		return errCodeCaptchaWrong
+	case errCaptchaExpired, errCaptchaAttempts, errCaptchaUsed:
+		return errCodeCaptchaExpired
+	}
+	return errCodeBadRequest
+}
+
+// apiVersion returns 2 if the client accepts the version 2 media type,
+// otherwise 1.
+func apiVersion(r *http.Request) int {
+	if r != nil && strings.Contains(r.Header.Get("Accept"), headerApplicationJSONV2) {
+		return 2
+	}
+	return 1
+}
+
+// v2 converts the error into the version 2 response.
+func (je JSONError) v2() JSONErrorV2 {
+	code := je.ErrorCode
+	if code == "" {
+		code = statusErrorCode(je.Code)
+	}
+	return JSONErrorV2{
+		Version:   2,
+		Code:      je.Code,
+		Error:     je.Error,
+		ErrorCode: code,
+		Fields:    je.Fields,
+	}
+}
@@ -0,0 +1,76 @@
+package mailout
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIVersion(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   int
+	}{
+		{"", 1},
+		{"application/json", 1},
+		{"application/vnd.mailout.v2+json", 2},
+		{"application/vnd.mailout.v2+json, application/json;q=0.9", 2},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.Header.Set("Accept", test.accept)
+		assert.Exactly(t, test.want, apiVersion(req), "Index %d", i)
+	}
+}
+
+func TestJSONError_V2(t *testing.T) {
+	assert.Exactly(t, JSONErrorV2{Version: 2, Code: 200}, JSONError{Code: 200}.v2())
+	assert.Exactly(t, JSONErrorV2{Version: 2, Code: 429, Error: "Too Many Requests", ErrorCode: errCodeRateLimited},
+		JSONError{Code: 429, Error: "Too Many Requests"}.v2())
+	assert.Exactly(t, JSONErrorV2{Version: 2, Code: 403, Error: "Origin not allowed", ErrorCode: errCodeOriginNotAllowed},
+		JSONError{Code: 403, Error: "Origin not allowed", ErrorCode: errCodeOriginNotAllowed}.v2())
+	assert.Exactly(t, errCodeInternal, statusErrorCode(http.StatusBadGateway))
+
+	assert.Exactly(t, errCodeCaptchaWrong, captchaErrorCode(errCaptchaWrong))
+	assert.Exactly(t, errCodeCaptchaExpired, captchaErrorCode(errCaptchaUsed))
+	assert.Exactly(t, errCodeEmailDisposable, errorCode(codedError{errCodeEmailDisposable, "x"}, errCodeUnprocessable))
+	assert.Exactly(t, errCodeUnprocessable, errorCode(errors.New("x"), errCodeUnprocessable))
+}
+
+func TestServeHTTP_APIVersion2(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		email_block spam.tld
+	}`)
+	if err := h.config.loadEmailPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		email    string
+		wantCode int
+		wantBody string
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, `{"version":2,"code":405,"error":"Method Not Allowed","error_code":"method_not_allowed"}`},
+		{"POST", "ken", StatusUnprocessableEntity, `{"version":2,"code":422,"error":"Invalid email address: \"ken\"","error_code":"invalid_email","fields":{"email":["is not a valid email address"]}}`},
+		{"POST", "ken@spam.tld", StatusUnprocessableEntity, `{"version":2,"code":422,"error":"Email domain blocked: \"spam.tld\"","error_code":"email_domain_blocked","fields":{"email":["Email domain blocked: \"spam.tld\""]}}`},
+		{"POST", "ken@thompson.email", http.StatusOK, `{"version":2,"code":200}`},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, "/mailout", nil)
+		req.Header.Set("Accept", headerApplicationJSONV2)
+		req.PostForm = url.Values{"email": {test.email}}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+		assert.Exactly(t, "application/vnd.mailout.v2+json; charset=utf-8", w.Header().Get(headerContentType), "Index %d", i)
+	}
+}
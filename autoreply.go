@@ -0,0 +1,124 @@
+package mailout
+
+import (
+	"strings"
+	"time"
+
+	"github.com/SchumacherFM/mailout/bufpool"
+	"gopkg.in/gomail.v2"
+)
+
+// autoreplyLimiter allows one autoreply per address and interval and at most
+// max autoreplies in total per interval, so the form cannot be abused to flood
+// third parties with emails. Not thread safe, only the mail daemon uses it.
+// The state is in memory only and starts empty after a restart.
+type autoreplyLimiter struct {
+	interval  time.Duration
+	max       int
+	now       func() time.Time
+	sent      map[string]time.Time
+	nextSweep time.Time
+	// count autoreplies sent since windowStart.
+	count       int
+	windowStart time.Time
+}
+
+func newAutoreplyLimiter(interval time.Duration, max int) *autoreplyLimiter {
+	return &autoreplyLimiter{
+		interval: interval,
+		max:      max,
+		now:      time.Now,
+		sent:     make(map[string]time.Time),
+	}
+}
+
+// allow returns true and records the autoreply if the address has not
+// received an autoreply within the interval and the total budget of the
+// interval has not been used up.
+func (l *autoreplyLimiter) allow(addr string) bool {
+	now := l.now()
+	if now.After(l.nextSweep) {
+		for a, t := range l.sent {
+			if now.Sub(t) >= l.interval {
+				delete(l.sent, a)
+			}
+		}
+		l.nextSweep = now.Add(l.interval)
+	}
+
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if t, ok := l.sent[addr]; ok && now.Sub(t) < l.interval {
+		return false
+	}
+	if now.Sub(l.windowStart) >= l.interval {
+		l.windowStart, l.count = now, 0
+	}
+	if l.max > 0 && l.count >= l.max {
+		return false
+	}
+	l.count++
+	l.sent[addr] = now
+	return true
+}
+
+// autoreply builds the confirmation email to the submitter. Returns nil if
+// the autoreply is disabled, the submission has been tagged as spam or the
+// address already received an autoreply within the interval.
+func (bm message) autoreply(l *autoreplyLimiter) *gomail.Message {
+	if bm.mc.autoreplyBodyTpl == nil {
+		return nil
+	}
+	if res, ok := spamResultFrom(bm.r.Context()); ok && res.action == spamActionTag {
+		return nil
+	}
+	email := strings.TrimSpace(bm.r.PostFormValue("email"))
+	if !isValidEmail(email) || !l.allow(email) {
+		return nil
+	}
+
+	// only the fields listed in autoreply_fields, the submitter could
+	// otherwise send any text to any address.
+	data := templateData{Form: bm.mc.autoreplyForm(bm.r.PostForm)}
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+
+	gm := gomail.NewMessage()
+	gm.SetHeader("To", email)
+	fromEmail, fromName := bm.mc.autoreplyFromEmail, bm.mc.autoreplyFromName
+	if fromEmail == "" {
+		fromEmail, fromName = bm.mc.fromEmail, bm.mc.fromName
+	}
+	if fromName != "" {
+		gm.SetAddressHeader("From", fromEmail, fromName)
+	} else {
+		gm.SetHeader("From", fromEmail)
+	}
+	// RFC 3834, prevents loops with other autoresponders
+	gm.SetHeader("Auto-Submitted", "auto-replied")
+
+	if err := bm.mc.autoreplySubjectTpl.Execute(buf, data); err != nil {
+		bm.mc.maillog.Errorf("Render Autoreply Subject Error: %s\nForm: %#v\nWritten: %s", err, bm.r.PostForm, buf)
+	}
+	gm.SetHeader("Subject", buf.String())
+	buf.Reset()
+
+	if err := bm.mc.autoreplyBodyTpl.Execute(buf, data); err != nil {
+		bm.mc.maillog.Errorf("Render Autoreply Error: %s\nForm: %#v\nWritten: %s", err, bm.r.PostForm, buf)
+	}
+	contentType := "text/plain"
+	if bm.mc.autoreplyBodyIsHTML {
+		contentType = "text/html"
+	}
+	gm.SetBody(contentType, buf.String())
+	return gm
+}
+
+// isSpamTagged returns true if spamd tagged the messages as spam.
+func isSpamTagged(mails messages) bool {
+	for _, m := range mails {
+		if s := m.GetHeader(headerSpamStatus); len(s) > 0 && strings.HasPrefix(s[0], "Yes") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package mailout
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+func TestAutoreplyLimiter(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newAutoreplyLimiter(time.Hour, 0)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.allow("ken@thompson.email"))
+	assert.False(t, l.allow("Ken@Thompson.email "))
+	assert.True(t, l.allow("rob@pike.email"))
+
+	now = now.Add(time.Minute * 59)
+	assert.False(t, l.allow("ken@thompson.email"))
+
+	now = now.Add(time.Minute * 2)
+	assert.True(t, l.allow("ken@thompson.email"))
+	// rob@pike.email has been swept
+	assert.Len(t, l.sent, 1)
+}
+
+func TestAutoreplyLimiter_Max(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newAutoreplyLimiter(time.Hour, 2)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.allow("ken@thompson.email"))
+	assert.True(t, l.allow("rob@pike.email"))
+	assert.False(t, l.allow("robert@griesemer.email"))
+	// a rejected address does not count as sent
+	assert.Len(t, l.sent, 2)
+
+	now = now.Add(time.Hour)
+	assert.True(t, l.allow("robert@griesemer.email"))
+}
+
+func newAutoreplyTestConfig(t *testing.T, caddyFile string) *config {
+	mc, err := parse(caddy.NewTestController("http", caddyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+func newAutoreplyTestRequest(form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = form
+	return req
+}
+
+func TestMessage_Autoreply(t *testing.T) {
+	mc := newAutoreplyTestConfig(t, `mailout {
+		to                   staff@domain.email
+		from_email           staff@domain.email
+		body                 testdata/mail_plainTextMessage.txt
+		autoreply_body       testdata/mail_autoreply.txt
+		autoreply_subject    "We received your message, {{.Form.Get \"name\"}}"
+		autoreply_from_email noreply@domain.email
+		autoreply_from_name  "Domain Support"
+		autoreply_fields     name
+	}`)
+	l := newAutoreplyLimiter(mc.autoreplyInterval, mc.autoreplyMax)
+
+	req := newAutoreplyTestRequest(url.Values{"email": {"ken@thompson.email"}, "name": {"Ken"}})
+	ar := newMessage(mc, req).autoreply(l)
+	if ar == nil {
+		t.Fatal("Missing autoreply")
+	}
+	buf := new(bytes.Buffer)
+	if _, err := ar.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "To: ken@thompson.email")
+	assert.Contains(t, buf.String(), `From: "Domain Support" <noreply@domain.email>`)
+	assert.Contains(t, buf.String(), "Subject: We received your message, Ken")
+	assert.Contains(t, buf.String(), "Auto-Submitted: auto-replied")
+	assert.Contains(t, buf.String(), "Content-Type: text/plain")
+	assert.Contains(t, buf.String(), "Hello Ken,")
+
+	// rate limited per address
+	assert.Nil(t, newMessage(mc, req).autoreply(l))
+	assert.NotNil(t, newMessage(mc, newAutoreplyTestRequest(url.Values{"email": {"rob@pike.email"}})).autoreply(l))
+
+	// invalid address
+	assert.Nil(t, newMessage(mc, newAutoreplyTestRequest(url.Values{"email": {"kenthompson.email"}})).autoreply(l))
+
+	// tagged by the spam rules
+	spamReq := newAutoreplyTestRequest(url.Values{"email": {"spam@domain.email"}})
+	spamReq = spamReq.WithContext(withSpamResult(spamReq.Context(), spamResult{action: spamActionTag}))
+	assert.Nil(t, newMessage(mc, spamReq).autoreply(l))
+}
+
+func TestMessage_AutoreplyDisabled(t *testing.T) {
+	mc := newAutoreplyTestConfig(t, `mailout {
+		to   staff@domain.email
+		body testdata/mail_plainTextMessage.txt
+	}`)
+	req := newAutoreplyTestRequest(url.Values{"email": {"ken@thompson.email"}})
+	assert.Nil(t, newMessage(mc, req).autoreply(newAutoreplyLimiter(time.Hour, 0)))
+}
+
+func TestMessage_AutoreplyFields(t *testing.T) {
+	mc := newAutoreplyTestConfig(t, `mailout {
+		from_email        staff@domain.email
+		body              testdata/mail_plainTextMessage.txt
+		autoreply_body    testdata/mail_autoreply.txt
+		autoreply_subject "Re: {{.Form.Get \"name\"}}{{.Form.Get \"message\"}}"
+	}`)
+	req := newAutoreplyTestRequest(url.Values{
+		"email":   {"ken@thompson.email"},
+		"name":    {"Ken"},
+		"message": {"Visit http://spam.email"},
+	})
+	ar := newMessage(mc, req).autoreply(newAutoreplyLimiter(time.Hour, 0))
+	if ar == nil {
+		t.Fatal("Missing autoreply")
+	}
+	buf := new(bytes.Buffer)
+	if _, err := ar.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	// no submitted fields without autoreply_fields
+	assert.Exactly(t, []string{"Re: "}, ar.GetHeader("Subject"))
+	assert.NotContains(t, buf.String(), "Ken")
+	assert.NotContains(t, buf.String(), "spam.email")
+}
+
+func TestMessage_AutoreplyDefaultFrom(t *testing.T) {
+	mc := newAutoreplyTestConfig(t, `mailout {
+		from_email     staff@domain.email
+		from_name      Staff
+		body           testdata/mail_plainTextMessage.txt
+		autoreply_body testdata/mail_tpl.html
+	}`)
+	req := newAutoreplyTestRequest(url.Values{"email": {"ken@thompson.email"}})
+	ar := newMessage(mc, req).autoreply(newAutoreplyLimiter(time.Hour, 0))
+	if ar == nil {
+		t.Fatal("Missing autoreply")
+	}
+	assert.Exactly(t, []string{`"Staff" <staff@domain.email>`}, ar.GetHeader("From"))
+	assert.Exactly(t, []string{"Thank you for your message"}, ar.GetHeader("Subject"))
+
+	buf := new(bytes.Buffer)
+	if _, err := ar.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "Content-Type: text/html")
+}
+
+func TestIsSpamTagged(t *testing.T) {
+	ham := gomail.NewMessage()
+	ham.SetHeader(headerSpamStatus, "No, score=1.0 required=5.0")
+	spam := gomail.NewMessage()
+	spam.SetHeader(headerSpamStatus, "Yes, score=8.0 required=5.0")
+
+	assert.False(t, isSpamTagged(nil))
+	assert.False(t, isSpamTagged(messages{gomail.NewMessage(), ham}))
+	assert.True(t, isSpamTagged(messages{ham, spam}))
+}
+
+func TestLoadTemplate_Autoreply(t *testing.T) {
+	c := caddy.NewTestController("http", `mailout {
+		from_email     staff@domain.email
+		body           testdata/mail_tpl.txt
+		autoreply_body testdata/mail_autoreply_NOTFOUND.txt
+	}`)
+	mc, err := parse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, mc.loadTemplate(), "[mailout] File \"testdata/mail_autoreply_NOTFOUND.txt\" not found")
+	assert.Nil(t, mc.autoreplyBodyTpl)
+}
@@ -0,0 +1,298 @@
+package mailout
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/SchumacherFM/mailout/maillog"
+)
+
+const (
+	bayesHam = iota
+	bayesSpam
+)
+
+// bayesRateLimitInterval and bayesRateLimitCapacity allow ten requests per
+// minute to the route {endpoint}/bayes.
+const (
+	bayesRateLimitInterval = time.Second * 6
+	bayesRateLimitCapacity = 10
+)
+
+// bayesClassifier a naive Bayes classifier trained from two directories
+// containing example submissions, e.g. sorted maillog files. Each file is one
+// document.
+type bayesClassifier struct {
+	mu   sync.RWMutex
+	dirs [2]string
+	// tokens number of documents per class containing the token.
+	tokens map[string]*[2]int
+	docs   [2]int
+}
+
+// newBayesClassifier creates the directories if needed and trains the
+// classifier with all files in there.
+func newBayesClassifier(hamDir, spamDir string) (*bayesClassifier, error) {
+	bc := &bayesClassifier{
+		dirs:   [2]string{hamDir, spamDir},
+		tokens: make(map[string]*[2]int),
+	}
+	for class, dir := range bc.dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("[mailout] Cannot create bayes directory %q: %s", dir, err)
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("[mailout] Cannot read bayes directory %q: %s", dir, err)
+		}
+		for _, f := range files {
+			if !f.Type().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("[mailout] Cannot read bayes file: %s", err)
+			}
+			bc.train(class, bayesText(data), 1)
+		}
+	}
+	return bc, nil
+}
+
+// train adds (delta 1) or removes (delta -1) a document. The caller must hold
+// the lock.
+func (bc *bayesClassifier) train(class int, text string, delta int) {
+	bc.docs[class] += delta
+	for t := range bayesTokens(text) {
+		c, ok := bc.tokens[t]
+		if !ok {
+			c = new([2]int)
+			bc.tokens[t] = c
+		}
+		c[class] += delta
+		if c[bayesHam] <= 0 && c[bayesSpam] <= 0 {
+			delete(bc.tokens, t)
+		}
+	}
+}
+
+// spamProbability returns the probability between 0 and 1 that the text is
+// spam. Returns 0.5 as long as one of the classes has not been trained.
+func (bc *bayesClassifier) spamProbability(text string) float64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.docs[bayesHam] <= 0 || bc.docs[bayesSpam] <= 0 {
+		return 0.5
+	}
+	var logP [2]float64
+	for class := range logP {
+		logP[class] = math.Log(float64(bc.docs[class]) / float64(bc.docs[bayesHam]+bc.docs[bayesSpam]))
+	}
+	for t := range bayesTokens(text) {
+		c, ok := bc.tokens[t]
+		if !ok {
+			continue // unknown tokens carry no information
+		}
+		for class := range logP {
+			// Laplace smoothing
+			logP[class] += math.Log(float64(c[class]+1) / float64(bc.docs[class]+2))
+		}
+	}
+	return 1 / (1 + math.Exp(logP[bayesHam]-logP[bayesSpam]))
+}
+
+// learn trains the document with the class and stores it in the directory of
+// the class. If the document has previously been stored in the other class,
+// it gets removed from there. The lock covers the files too, so concurrent
+// requests cannot train the same file twice.
+func (bc *bayesClassifier) learn(class int, name string, data []byte) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	name = filepath.Base(name)
+	other := filepath.Join(bc.dirs[1-class], name)
+	if old, err := os.ReadFile(other); err == nil {
+		if err := os.Remove(other); err != nil {
+			return err
+		}
+		bc.train(1-class, bayesText(old), -1)
+	}
+
+	target := filepath.Join(bc.dirs[class], name)
+	if _, err := os.Stat(target); err == nil {
+		return nil // already trained
+	}
+	if err := os.WriteFile(target, data, 0600); err != nil {
+		return err
+	}
+	bc.train(class, bayesText(data), 1)
+	return nil
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// bayesText returns the text of a training file. Logged emails get their
+// headers stripped and their bodies decoded, so the classifier learns the
+// words of the submission and not those of the MIME encoding. Attachments and
+// PGP encrypted bodies get skipped. Other files, e.g. hand written examples,
+// get used as they are.
+func bayesText(data []byte) string {
+	var buf bytes.Buffer
+	for _, raw := range bytes.Split(data, maillog.MultiMessageSeparator) {
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil || (msg.Header.Get("Mime-Version") == "" && msg.Header.Get("From") == "") {
+			buf.Write(raw)
+			buf.WriteByte('\n')
+			continue
+		}
+		writeMIMEText(&buf, textproto.MIMEHeader(msg.Header), msg.Body)
+	}
+	return buf.String()
+}
+
+// writeMIMEText writes the decoded text of a MIME entity and its parts.
+func writeMIMEText(buf *bytes.Buffer, h textproto.MIMEHeader, body io.Reader) {
+	if strings.HasPrefix(strings.ToLower(h.Get("Content-Disposition")), "attachment") {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			writeMIMEText(buf, p.Header, p)
+		}
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	text, err := io.ReadAll(body)
+	if err != nil || bytes.Contains(text, []byte("-----BEGIN PGP MESSAGE-----")) {
+		return
+	}
+	if mediaType == "text/html" {
+		text = []byte(html.UnescapeString(string(htmlTagRe.ReplaceAll(text, []byte(" ")))))
+	}
+	buf.Write(text)
+	buf.WriteByte('\n')
+}
+
+// bayesTokens returns the set of lower case words with 3 to 40 letters or
+// digits.
+func bayesTokens(text string) map[string]struct{} {
+	tokens := make(map[string]struct{})
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if l := len([]rune(w)); l >= 3 && l <= 40 {
+			tokens[w] = struct{}{}
+		}
+	}
+	return tokens
+}
+
+// serveBayes marks a submission in the maillog directory as spam or ham and
+// retrains the classifier. Requires the admin token in the Authorization
+// header: Bearer <token>
+func (h *handler) serveBayes(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusMethodNotAllowed,
+			Error: http.StatusText(http.StatusMethodNotAllowed),
+		}, w, r)
+	}
+	// limits guessing the token. The route has its own bucket, so the form
+	// traffic and the admin cannot lock out each other.
+	if h.bayesBucket.TakeAvailable(1) == 0 {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusTooManyRequests,
+			Error: http.StatusText(http.StatusTooManyRequests),
+		}, w, r)
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.bayesAdminToken)) != 1 {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusUnauthorized,
+			Error: http.StatusText(http.StatusUnauthorized),
+		}, w, r)
+	}
+	limitBody(h.config, w, r)
+	if err := r.ParseForm(); err != nil {
+		if isBodyTooLarge(err) {
+			return h.writeJSON(JSONError{
+				Code:  http.StatusRequestEntityTooLarge,
+				Error: "Request body too large",
+			}, w, r)
+		}
+		return h.writeJSON(JSONError{
+			Code:  http.StatusBadRequest,
+			Error: err.Error(),
+		}, w, r)
+	}
+
+	var class int
+	switch r.PostFormValue("class") {
+	case "ham":
+		class = bayesHam
+	case "spam":
+		class = bayesSpam
+	default:
+		return h.writeJSON(JSONError{
+			Code:  StatusUnprocessableEntity,
+			Error: "Field class must be spam or ham",
+		}, w, r)
+	}
+
+	name := filepath.Base(r.PostFormValue("file"))
+	if name == "." || name == string(filepath.Separator) {
+		return h.writeJSON(JSONError{
+			Code:  StatusUnprocessableEntity,
+			Error: "Field file is missing",
+		}, w, r)
+	}
+	data, err := os.ReadFile(filepath.Join(h.config.maillog.MailDir, name))
+	if err != nil {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusNotFound,
+			Error: fmt.Sprintf("Logged submission %q not found", name),
+		}, w, r)
+	}
+	if err := h.config.bayes.learn(class, name, data); err != nil {
+		h.config.maillog.Errorf("[mailout] Bayes learn %q: %s", name, err)
+		return h.writeJSON(JSONError{
+			Code:  http.StatusInternalServerError,
+			Error: http.StatusText(http.StatusInternalServerError),
+		}, w, r)
+	}
+	return h.writeJSON(JSONError{Code: http.StatusOK}, w, r)
+}
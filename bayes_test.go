@@ -0,0 +1,290 @@
+package mailout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// copyBayesTestdata copies the training files into a temporary directory
+// because learning writes into the directories.
+func copyBayesTestdata(t *testing.T) (hamDir, spamDir string) {
+	dir := t.TempDir()
+	for _, class := range []string{"ham", "spam"} {
+		files, err := filepath.Glob(filepath.Join("testdata", "bayes", class, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, class), 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, class, filepath.Base(f)), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return filepath.Join(dir, "ham"), filepath.Join(dir, "spam")
+}
+
+func TestBayesClassifier_SpamProbability(t *testing.T) {
+
+	bc, err := newBayesClassifier("testdata/bayes/ham", "testdata/bayes/spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, [2]int{3, 3}, bc.docs)
+
+	tests := []struct {
+		text     string
+		wantSpam bool
+	}{
+		{"Click here for a casino bonus and free money", true},
+		{"Cheap SEO backlinks, limited offer", true},
+		{"Please send the invoice for my order", false},
+		{"Thank you, the garden book arrived today", false},
+	}
+	for i, test := range tests {
+		p := bc.spamProbability(test.text)
+		if test.wantSpam {
+			assert.True(t, p > 0.9, "Index %d: %f", i, p)
+		} else {
+			assert.True(t, p < 0.1, "Index %d: %f", i, p)
+		}
+	}
+	// unknown words carry no information and result in the prior
+	assert.InDelta(t, 0.5, bc.spamProbability("zzz yyy xxx"), 0.0001)
+
+	empty, err := newBayesClassifier(filepath.Join(t.TempDir(), "ham"), filepath.Join(t.TempDir(), "spam"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, 0.5, empty.spamProbability("Click here for a casino bonus"))
+}
+
+func TestBayesClassifier_Learn(t *testing.T) {
+
+	hamDir, spamDir := copyBayesTestdata(t)
+	bc, err := newBayesClassifier(hamDir, spamDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "Exclusive crypto giveaway for our newsletter readers"
+	assert.NoError(t, bc.learn(bayesHam, "mail_4.txt", []byte(msg)))
+	assert.Exactly(t, [2]int{4, 3}, bc.docs)
+	pHam := bc.spamProbability("crypto giveaway")
+
+	// learning the same file twice must not count twice
+	assert.NoError(t, bc.learn(bayesHam, "mail_4.txt", []byte(msg)))
+	assert.Exactly(t, [2]int{4, 3}, bc.docs)
+
+	// moves the file from ham to spam
+	assert.NoError(t, bc.learn(bayesSpam, "../mail_4.txt", []byte(msg)))
+	assert.Exactly(t, [2]int{3, 4}, bc.docs)
+	assert.True(t, bc.spamProbability("crypto giveaway") > pHam)
+	assert.NoFileExists(t, filepath.Join(hamDir, "mail_4.txt"))
+	assert.FileExists(t, filepath.Join(spamDir, "mail_4.txt"))
+
+	// a restart trains the same model from the directories
+	bc2, err := newBayesClassifier(hamDir, spamDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, bc.docs, bc2.docs)
+	assert.Exactly(t, bc.tokens, bc2.tokens)
+}
+
+func TestBayesTokens(t *testing.T) {
+	assert.Exactly(t, map[string]struct{}{
+		"hello":  {},
+		"world":  {},
+		"привет": {},
+		"2024":   {},
+	}, bayesTokens("Hello, WORLD! hello a to привет 2024 "+strings.Repeat("x", 41)))
+}
+
+func TestSpamRules_Bayes(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(file, []byte(`{"tag":3,"rules":[{"name":"bayes","type":"bayes","fields":["message"],"max":0.9,"score":5}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadSpamRules(file, nil)
+	assert.EqualError(t, err, `[mailout] Spam rule "bayes" in "`+file+`": requires bayes_ham and bayes_spam`)
+
+	bc, err := newBayesClassifier("testdata/bayes/ham", "testdata/bayes/spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := loadSpamRules(file, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := sr.score(url.Values{"message": {"Win free money at the casino, click here"}}, nil)
+	assert.Exactly(t, []string{"bayes"}, res.Matches)
+	assert.Exactly(t, 5.0, res.Score)
+	assert.True(t, res.Bayes > 0.9)
+	assert.Exactly(t, spamActionTag, res.action)
+
+	res = sr.score(url.Values{
+		"message": {"Please send the invoice for my order"},
+		"name":    {"casino click here"},
+	}, nil)
+	assert.Nil(t, res.Matches)
+	assert.True(t, res.Bayes < 0.1)
+	assert.Exactly(t, spamActionNone, res.action)
+}
+
+func TestServeHTTP_Bayes(t *testing.T) {
+
+	hamDir, spamDir := copyBayesTestdata(t)
+	mailDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(mailDir, "mail_localhost_1.txt"), []byte(testBayesMail), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHandler(t, `mailout {
+		bayes_ham         `+hamDir+`
+		bayes_spam        `+spamDir+`
+		bayes_admin_token s3cr3t
+		maillog           `+mailDir+`
+		max_body_size     100
+	}`)
+	if err := h.config.loadBayes(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		token    string
+		form     url.Values
+		wantCode int
+		wantBody string
+	}{
+		{"GET", "s3cr3t", nil, http.StatusMethodNotAllowed, ""},
+		{"POST", "", url.Values{"class": {"spam"}, "file": {"mail_localhost_1.txt"}}, http.StatusUnauthorized, ""},
+		{"POST", "wrong", url.Values{"class": {"spam"}, "file": {"mail_localhost_1.txt"}}, http.StatusUnauthorized, ""},
+		{"POST", "s3cr3t", url.Values{"class": {"eggs"}, "file": {"mail_localhost_1.txt"}}, StatusUnprocessableEntity, "Field class must be spam or ham"},
+		{"POST", "s3cr3t", url.Values{"class": {"spam"}}, StatusUnprocessableEntity, "Field file is missing"},
+		{"POST", "s3cr3t", url.Values{"class": {"spam"}, "file": {"../mail_1.txt"}}, http.StatusNotFound, `Logged submission \"mail_1.txt\" not found`},
+		{"POST", "s3cr3t", url.Values{"class": {"spam"}, "file": {strings.Repeat("x", 100)}}, http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"POST", "s3cr3t", url.Values{"class": {"spam"}, "file": {"mail_localhost_1.txt"}}, http.StatusOK, ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, "/mailout/bayes", strings.NewReader(test.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Contains(t, w.Body.String(), test.wantBody, "Index %d", i)
+	}
+	assert.Exactly(t, [2]int{3, 4}, h.config.bayes.docs)
+	assert.FileExists(t, filepath.Join(spamDir, "mail_localhost_1.txt"))
+	// no tokens of the headers, the encoding or the encrypted copy
+	for _, tok := range []string{"mime", "charset", "printable", "multipart", "cipher", "encrypted"} {
+		assert.Nil(t, h.config.bayes.tokens[tok], tok)
+	}
+	assert.Exactly(t, &[2]int{0, 1}, h.config.bayes.tokens["giveaway"])
+}
+
+func TestServeHTTP_BayesLimits(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		bayes_ham          `+t.TempDir()+`
+		bayes_spam         `+t.TempDir()+`
+		bayes_admin_token  s3cr3t
+		maillog            `+t.TempDir()+`
+		ratelimit_capacity 2
+		block_ips          192.0.2.66
+	}`)
+	if err := h.config.loadBayes(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= bayesRateLimitCapacity; i++ {
+		req := httptest.NewRequest("POST", "/mailout/bayes", nil)
+		req.Header.Set("Authorization", "Bearer guess")
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		wantCode := http.StatusUnauthorized
+		if i == bayesRateLimitCapacity {
+			wantCode = http.StatusTooManyRequests
+		}
+		assert.Exactly(t, wantCode, w.Code, "Index %d", i)
+	}
+	// the form has its own bucket
+	assert.Exactly(t, int64(2), h.rlBucket.Available())
+
+	req := httptest.NewRequest("POST", "/mailout/bayes", nil)
+	req.RemoteAddr = "192.0.2.66:1234"
+	w := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusForbidden, w.Code)
+}
+
+// testBayesMail a logged email with an encrypted copy for a PGP recipient.
+const testBayesMail = "Mime-Version: 1.0\r\n" +
+	"From: ken@thompson.email\r\n" +
+	"Subject: =?UTF-8?q?Contact_form?=\r\n" +
+	"Content-Type: multipart/alternative; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Exclusive crypto giveaway for our newsletter readers, a very long line whi=\r\n" +
+	"ch gets wrapped by the encoding\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PGRpdiBjbGFzcz0iYm9keSI+Q3J5cHRvICZhbXA7IGJvbnVzPC9kaXY+\r\n" +
+	"--b1--\r\n" +
+	"\n\n================================================================================\n\n" +
+	"Mime-Version: 1.0\r\n" +
+	"From: ken@thompson.email\r\n" +
+	"Content-Type: multipart/mixed; boundary=b2\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"-----BEGIN PGP MESSAGE-----\r\n" +
+	"wcBMA0fcZ7XLgmf2AQf/cipher\r\n" +
+	"-----END PGP MESSAGE-----\r\n" +
+	"--b2\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"encrypted.gpg\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c2VjcmV0IHN0dWZm\r\n" +
+	"--b2--\r\n"
+
+func TestBayesText(t *testing.T) {
+	assert.Exactly(t,
+		"Exclusive crypto giveaway for our newsletter readers, a very long line which gets wrapped by the encoding\n Crypto & bonus \n",
+		bayesText([]byte(testBayesMail)))
+	// hand written examples
+	assert.Exactly(t, "Cheap casino bonus\n", bayesText([]byte("Cheap casino bonus")))
+}
@@ -0,0 +1,358 @@
+package mailout
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"image/color"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SchumacherFM/mailout/bufpool"
+	"github.com/gorilla/sessions"
+	"github.com/quasoft/memstore"
+	"github.com/steambap/captcha"
+)
+
+// defaultCaptchaCharset omits characters which can be easily mixed up.
+const defaultCaptchaCharset = "ABCDEFGHKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
+
+const (
+	// captchaSessionName name of the session and its cookie.
+	captchaSessionName = "captcha"
+	// captchaField form field name containing the solution typed by the user.
+	captchaField = "captcha_text"
+	// captchaIDField form field name containing the id of the JSON captcha.
+	captchaIDField = "captcha_id"
+	// captchaQuestionIDField form field name containing the id of the text
+	// question of the JSON captcha.
+	captchaQuestionIDField = "captcha_question_id"
+
+	sessKeyAnswer   = "captcha"
+	sessKeyExpires  = "captcha_expires"
+	sessKeyAttempts = "captcha_attempts"
+)
+
+// Errors of the built-in captcha. They must never contain the solution.
+var (
+	errCaptchaWrong    = errors.New("Wrong captcha_text")
+	errCaptchaExpired  = errors.New("Captcha expired. Please reload the image")
+	errCaptchaAttempts = errors.New("Too many wrong attempts. Please reload the image")
+)
+
+// captchaQuestion text question configured with captcha_question. Any of the
+// answers gets accepted, case insensitive.
+type captchaQuestion struct {
+	text    string
+	answers []string
+}
+
+// imageCaptcha generates captcha images and stores the solution in an in
+// memory session referenced by a cookie.
+type imageCaptcha struct {
+	width       int
+	height      int
+	length      int
+	charset     string
+	noise       float64
+	curves      int
+	ignoreCase  bool
+	ttl         time.Duration
+	maxAttempts int
+	store       *memstore.MemStore
+	// sealer creates the tokens for the stateless mode and the ids of the
+	// JSON captcha.
+	sealer *captchaSealer
+	// stateless uses the sealed tokens instead of the session.
+	stateless bool
+	// json accepts the ids of the JSON captcha.
+	json bool
+	// mu protects expires. expires contains the expiry time of the sessions
+	// in the store by id, because the store never removes them on its own.
+	mu        sync.Mutex
+	expires   map[string]int64
+	nextSweep int64
+	// questions offered by the JSON captcha as alternative to the image.
+	// questionSealer seals their answers, nil without questions.
+	questions      []captchaQuestion
+	questionSealer *captchaSealer
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+// newImageCaptcha creates the captcha from the configuration. Empty keys get
+// replaced with random keys which are only valid for the lifetime of the
+// process. In stateless mode the encryption key seals the tokens.
+func newImageCaptcha(c *config) (ic *imageCaptcha, err error) {
+	authKey, encKey := []byte(c.captchaAuthKey), []byte(c.captchaEncKey)
+	if len(authKey) == 0 {
+		authKey = randomKey(32)
+	}
+	if len(encKey) == 0 {
+		encKey = randomKey(32)
+	}
+	store := memstore.NewMemStore(authKey, encKey)
+	store.Options.HttpOnly = true
+	store.Options.Path = c.endpoint
+	store.Options.MaxAge = int(c.captchaTTL / time.Second)
+
+	ic = &imageCaptcha{
+		width:       c.captchaWidth,
+		height:      c.captchaHeight,
+		length:      c.captchaLength,
+		charset:     c.captchaCharset,
+		noise:       c.captchaNoise,
+		curves:      c.captchaCurves,
+		ignoreCase:  c.captchaIgnoreCase,
+		ttl:         c.captchaTTL,
+		maxAttempts: c.captchaMaxAttempts,
+		store:       store,
+		stateless:   c.captchaStateless,
+		json:        c.captchaJSON,
+		questions:   c.captchaQuestions,
+		expires:     make(map[string]int64),
+		now:         time.Now,
+	}
+	// the key length has been validated in loadFromEnv.
+	ic.sealer, err = newCaptchaSealer(encKey, c.captchaIgnoreCase, func() time.Time { return ic.now() })
+	if err != nil {
+		return nil, err
+	}
+	if c.captchaReplayDir != "" {
+		ic.sealer.replay = newReplayDir(c.captchaReplayDir)
+	}
+	if len(ic.questions) == 0 {
+		return ic, nil
+	}
+	ic.questionSealer, err = newCaptchaSealer(encKey, true, func() time.Time { return ic.now() })
+	if err != nil {
+		return nil, err
+	}
+	ic.questionSealer.aad = captchaQuestionAAD
+	// the nonces are random, so both sealers can share the store
+	ic.questionSealer.replay = ic.sealer.replay
+	return ic, nil
+}
+
+// generate creates a new image and its solution.
+func (ic *imageCaptcha) generate() (*captcha.Data, error) {
+	return captcha.New(ic.width, ic.height, func(o *captcha.Options) {
+		o.BackgroundColor = color.White
+		o.CharPreset = ic.charset
+		o.FontDPI = 82
+		o.CurveNumber = ic.curves
+		o.Noise = ic.noise
+		o.TextLength = ic.length
+	})
+}
+
+// newChallenge generates a captcha and stores its solution in the session.
+// Any previous solution of the session gets replaced.
+func (ic *imageCaptcha) newChallenge(w http.ResponseWriter, r *http.Request) (*captcha.Data, error) {
+	data, err := ic.generate()
+	if err != nil {
+		return nil, err
+	}
+	if ic.stateless {
+		token := ic.sealer.seal(ic.now().Add(ic.ttl), data.Text)
+		w.Header().Set(captchaTokenHeader, token)
+		http.SetCookie(w, &http.Cookie{
+			Name:     captchaTokenField,
+			Value:    token,
+			Path:     ic.store.Options.Path,
+			MaxAge:   ic.store.Options.MaxAge,
+			HttpOnly: true,
+		})
+		return data, nil
+	}
+	session, err := ic.store.New(r, captchaSessionName)
+	if err != nil {
+		// invalid cookie, e.g. after a restart with random keys. The new
+		// session gets a new cookie.
+		session.IsNew = true
+	}
+	exp := ic.now().Add(ic.ttl).Unix()
+	session.Values[sessKeyAnswer] = data.Text
+	session.Values[sessKeyExpires] = exp
+	session.Values[sessKeyAttempts] = 0
+	if err := ic.store.Save(r, w, session); err != nil {
+		return nil, err
+	}
+	ic.track(session.ID, exp)
+	return data, nil
+}
+
+// track remembers the expiry time of the session and deletes the expired
+// sessions from the store at most once per minute. Otherwise each image
+// request without cookie would leave a session behind.
+func (ic *imageCaptcha) track(id string, exp int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	now := ic.now().Unix()
+	if now >= ic.nextSweep {
+		for sid, e := range ic.expires {
+			if now > e {
+				ic.deleteSession(sid)
+				delete(ic.expires, sid)
+			}
+		}
+		ic.nextSweep = now + 60
+	}
+	ic.expires[id] = exp
+}
+
+// deleteSession removes the session from the store. The store deletes a
+// session when it gets saved with a negative MaxAge.
+func (ic *imageCaptcha) deleteSession(id string) {
+	s := sessions.NewSession(ic.store, captchaSessionName)
+	s.ID = id
+	s.Options = &sessions.Options{MaxAge: -1}
+	_ = ic.store.Save(nil, discardResponseWriter{}, s)
+}
+
+// discardResponseWriter drops the cookie of store operations which are not
+// part of a request.
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
+
+// verify compares the submitted text with the solution in the session. A
+// solution can only be used once, expires and allows a limited number of
+// wrong attempts. In stateless mode or if an id of the enabled JSON captcha
+// has been submitted, the solution gets compared with the sealed token which
+// allows only one attempt. The same applies to the id of a text question.
+func (ic *imageCaptcha) verify(w http.ResponseWriter, r *http.Request, text string) error {
+	if id := r.PostFormValue(captchaQuestionIDField); ic.questionSealer != nil && id != "" {
+		return ic.questionSealer.open(id, text)
+	}
+	if id := r.PostFormValue(captchaIDField); ic.json && id != "" {
+		return ic.sealer.open(id, text)
+	}
+	if ic.stateless {
+		return ic.sealer.open(tokenFromRequest(r), text)
+	}
+	session, err := ic.store.Get(r, captchaSessionName)
+	if err != nil {
+		return err
+	}
+	answer, _ := session.Values[sessKeyAnswer].(string)
+	if answer == "" {
+		return errCaptchaWrong
+	}
+	if exp, _ := session.Values[sessKeyExpires].(int64); ic.now().Unix() > exp {
+		ic.invalidate(w, r, session)
+		return errCaptchaExpired
+	}
+	if !ic.equal(answer, text) {
+		attempts, _ := session.Values[sessKeyAttempts].(int)
+		attempts++
+		session.Values[sessKeyAttempts] = attempts
+		if ic.maxAttempts > 0 && attempts >= ic.maxAttempts {
+			ic.invalidate(w, r, session)
+			return errCaptchaAttempts
+		}
+		_ = ic.store.Save(r, w, session)
+		return errCaptchaWrong
+	}
+	// single use
+	ic.invalidate(w, r, session)
+	return nil
+}
+
+// invalidate deletes the session from the store and its cookie.
+func (ic *imageCaptcha) invalidate(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	session.Options.MaxAge = -1
+	_ = ic.store.Save(r, w, session)
+	ic.mu.Lock()
+	delete(ic.expires, session.ID)
+	ic.mu.Unlock()
+}
+
+// isCaptchaError returns true if the error has been caused by a wrong or
+// outdated solution.
+func isCaptchaError(err error) bool {
+	return err == errCaptchaWrong || err == errCaptchaExpired || err == errCaptchaAttempts || err == errCaptchaUsed
+}
+
+func (ic *imageCaptcha) equal(answer, text string) bool {
+	if ic.ignoreCase {
+		answer, text = strings.ToLower(answer), strings.ToLower(text)
+	}
+	return subtle.ConstantTimeCompare([]byte(answer), []byte(strings.TrimSpace(text))) == 1
+}
+
+// serveCaptchaImage writes a new captcha image.
+func (h *handler) serveCaptchaImage(w http.ResponseWriter, r *http.Request) (int, error) {
+	data, err := h.captcha.newChallenge(w, r)
+	if err != nil {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusInternalServerError,
+			Error: err.Error(),
+		}, w, r)
+	}
+	w.Header().Set(headerContentType, headerPNG)
+	w.Header().Set("Cache-Control", "no-store")
+	return http.StatusOK, data.WriteImage(w)
+}
+
+// JSONCaptcha gets returned by the route {endpoint}/captcha.json. The id must
+// be posted back in the field captcha_id together with the solution of the
+// image in the field captcha_text.
+type JSONCaptcha struct {
+	ID string `json:"id"`
+	// Image data URI of the PNG image.
+	Image string `json:"image"`
+	// Question accessible alternative to the image, only if configured. To
+	// answer it, QuestionID must be posted back in the field
+	// captcha_question_id together with the answer in the field captcha_text.
+	Question   string `json:"question,omitempty"`
+	QuestionID string `json:"question_id,omitempty"`
+}
+
+// newJSONChallenge generates a captcha image and picks a random question, if
+// configured. The solutions get sealed into the ids, no cookie is required.
+func (ic *imageCaptcha) newJSONChallenge() (*JSONCaptcha, error) {
+	data, err := ic.generate()
+	if err != nil {
+		return nil, err
+	}
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := data.WriteImage(buf); err != nil {
+		return nil, err
+	}
+	jc := &JSONCaptcha{
+		ID:    ic.sealer.seal(ic.now().Add(ic.ttl), data.Text),
+		Image: "data:" + headerPNG + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}
+	if len(ic.questions) > 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(ic.questions))))
+		if err != nil {
+			return nil, err
+		}
+		q := ic.questions[n.Int64()]
+		jc.Question = q.text
+		jc.QuestionID = ic.questionSealer.seal(ic.now().Add(ic.ttl), q.answers...)
+	}
+	return jc, nil
+}
+
+// serveCaptchaJSON writes a new captcha as JSON.
+func (h *handler) serveCaptchaJSON(w http.ResponseWriter, r *http.Request) (int, error) {
+	jc, err := h.captcha.newJSONChallenge()
+	if err != nil {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusInternalServerError,
+			Error: err.Error(),
+		}, w, r)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return h.writeJSONValue(http.StatusOK, jc, w)
+}
@@ -0,0 +1,292 @@
+package mailout
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steambap/captcha"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCaptchaRequest creates a POST request containing the session cookies of
+// the recorder and the submitted text.
+func newCaptchaRequest(rec *httptest.ResponseRecorder, text string) *http.Request {
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = url.Values{
+		"email":      []string{"ken@thompson.email"},
+		captchaField: []string{text},
+	}
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestImageCaptcha_Verify(t *testing.T) {
+
+	mc := newConfig()
+	mc.captchaLength = 6
+	mc.captchaCharset = "ABC"
+	ic, err := newImageCaptcha(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	data, err := ic.newChallenge(rec, httptest.NewRequest("GET", "/mailout/captcha", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, data.Text, 6)
+	assert.Empty(t, strings.Trim(data.Text, "ABC"))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Exactly(t, "/mailout", cookies[0].Path)
+
+	// wrong answers must never reveal the solution
+	err = ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, "XYZ"), "XYZ")
+	assert.Exactly(t, errCaptchaWrong, err)
+	assert.NotContains(t, err.Error(), data.Text)
+
+	// lower case not accepted
+	req := newCaptchaRequest(rec, "")
+	assert.Exactly(t, errCaptchaWrong, ic.verify(httptest.NewRecorder(), req, strings.ToLower(data.Text)))
+
+	req = newCaptchaRequest(rec, "")
+	assert.NoError(t, ic.verify(httptest.NewRecorder(), req, data.Text))
+
+	// single use
+	req = newCaptchaRequest(rec, "")
+	assert.Exactly(t, errCaptchaWrong, ic.verify(httptest.NewRecorder(), req, data.Text))
+}
+
+func TestImageCaptcha_MaxAttempts(t *testing.T) {
+
+	mc := newConfig()
+	mc.captchaMaxAttempts = 2
+	ic, err := newImageCaptcha(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	data, err := ic.newChallenge(rec, httptest.NewRequest("GET", "/mailout/captcha", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, errCaptchaWrong, ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, ""), "wrong"))
+	assert.Exactly(t, errCaptchaAttempts, ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, ""), "wrong"))
+	// the correct answer is not accepted anymore
+	assert.Exactly(t, errCaptchaWrong, ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, ""), data.Text))
+}
+
+func TestImageCaptcha_Expires(t *testing.T) {
+
+	mc := newConfig()
+	mc.captchaIgnoreCase = true
+	ic, err := newImageCaptcha(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ic.now = func() time.Time { return now }
+
+	rec := httptest.NewRecorder()
+	data, err := ic.newChallenge(rec, httptest.NewRequest("GET", "/mailout/captcha", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.now = func() time.Time { return now.Add(mc.captchaTTL + time.Second) }
+	assert.Exactly(t, errCaptchaExpired, ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, ""), data.Text))
+
+	rec = httptest.NewRecorder()
+	ic.now = func() time.Time { return now }
+	data, err = ic.newChallenge(rec, httptest.NewRequest("GET", "/mailout/captcha", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, ic.verify(httptest.NewRecorder(), newCaptchaRequest(rec, ""), " "+strings.ToLower(data.Text)))
+}
+
+func TestImageCaptcha_Sweep(t *testing.T) {
+
+	ic, err := newImageCaptcha(newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ic.now = func() time.Time { return now }
+
+	var rec *httptest.ResponseRecorder
+	var data *captcha.Data
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		if data, err = ic.newChallenge(rec, httptest.NewRequest("GET", "/mailout/captcha", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Len(t, ic.expires, 3)
+
+	// a solved captcha gets deleted together with its cookie
+	w := httptest.NewRecorder()
+	assert.NoError(t, ic.verify(w, newCaptchaRequest(rec, ""), data.Text))
+	assert.Len(t, ic.expires, 2)
+	if cookies := w.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.True(t, cookies[0].MaxAge < 0)
+	}
+
+	// expired sessions get deleted with the next challenge
+	now = now.Add(ic.ttl + time.Minute)
+	if _, err := ic.newChallenge(httptest.NewRecorder(), httptest.NewRequest("GET", "/mailout/captcha", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, ic.expires, 1)
+}
+
+func TestServeHTTP_Captcha(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		captcha
+		captcha_size 200 80
+	}`)
+
+	rec := httptest.NewRecorder()
+	code, err := h.ServeHTTP(rec, httptest.NewRequest("GET", "/mailout/captcha", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, code)
+	assert.Exactly(t, headerPNG, rec.Header().Get(headerContentType))
+	assert.Exactly(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	w := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, newCaptchaRequest(rec, "wrong")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusUnauthorized, w.Code)
+	assert.Exactly(t, "{\"code\":401,\"error\":\"Wrong captcha_text\"}\n", w.Body.String())
+}
+
+func TestServeHTTP_CaptchaJSON(t *testing.T) {
+
+	// opt-in, the ids are not accepted without captcha_json
+	h := newTestHandler(t, `mailout {
+		captcha
+	}`)
+	rec := httptest.NewRecorder()
+	code, err := h.ServeHTTP(rec, httptest.NewRequest("GET", "/mailout/captcha.json", nil))
+	assert.NoError(t, err)
+	assert.Exactly(t, http.StatusTeapot, code)
+	jc, err := h.captcha.newJSONChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = url.Values{
+		"email":        []string{"ken@thompson.email"},
+		captchaIDField: []string{jc.ID},
+		captchaField:   []string{"AAAAA"},
+	}
+	assert.Error(t, h.captcha.verify(httptest.NewRecorder(), req, "AAAAA"))
+
+	h = newTestHandler(t, `mailout {
+		captcha
+		captcha_json
+		captcha_charset A
+	}`)
+
+	rec = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(rec, httptest.NewRequest("GET", "/mailout/captcha.json", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, rec.Code)
+	assert.Exactly(t, headerApplicationJSONUTF8, rec.Header().Get(headerContentType))
+	assert.Empty(t, rec.Result().Cookies())
+
+	jc = &JSONCaptcha{}
+	if err := json.NewDecoder(rec.Body).Decode(jc); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, jc.ID)
+	assert.True(t, strings.HasPrefix(jc.Image, "data:image/png;base64,"), jc.Image)
+	if _, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(jc.Image, "data:image/png;base64,")); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(text string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{
+			"email":        []string{"ken@thompson.email"},
+			captchaIDField: []string{jc.ID},
+			captchaField:   []string{text},
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	assert.Exactly(t, http.StatusOK, post("AAAAA").Code)
+	// the id can only be used once
+	assert.Exactly(t, http.StatusUnauthorized, post("AAAAA").Code)
+}
+
+func TestServeHTTP_CaptchaQuestion(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		captcha
+		captcha_json
+		captcha_question "What is the name of our town?" Berlin "Berlin-Mitte"
+	}`)
+
+	newChallenge := func() *JSONCaptcha {
+		rec := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(rec, httptest.NewRequest("GET", "/mailout/captcha.json", nil)); err != nil {
+			t.Fatal(err)
+		}
+		jc := &JSONCaptcha{}
+		if err := json.NewDecoder(rec.Body).Decode(jc); err != nil {
+			t.Fatal(err)
+		}
+		return jc
+	}
+	post := func(field, id, text string) int {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{
+			"email":      []string{"ken@thompson.email"},
+			field:        []string{id},
+			captchaField: []string{text},
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code
+	}
+
+	jc := newChallenge()
+	assert.Exactly(t, "What is the name of our town?", jc.Question)
+	assert.NotEmpty(t, jc.QuestionID)
+	assert.NotEqual(t, jc.ID, jc.QuestionID)
+
+	// case insensitive, each answer gets accepted once
+	assert.Exactly(t, http.StatusOK, post(captchaQuestionIDField, jc.QuestionID, " berlin "))
+	assert.Exactly(t, http.StatusUnauthorized, post(captchaQuestionIDField, jc.QuestionID, "Berlin"))
+	assert.Exactly(t, http.StatusOK, post(captchaQuestionIDField, newChallenge().QuestionID, "BERLIN-MITTE"))
+	assert.Exactly(t, http.StatusUnauthorized, post(captchaQuestionIDField, newChallenge().QuestionID, "Paris"))
+
+	// the ids of the image and the question cannot be swapped
+	jc = newChallenge()
+	assert.Exactly(t, http.StatusUnauthorized, post(captchaIDField, jc.QuestionID, "Berlin"))
+	assert.Exactly(t, http.StatusUnauthorized, post(captchaQuestionIDField, jc.ID, "Berlin"))
+}
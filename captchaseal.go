@@ -0,0 +1,220 @@
+package mailout
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// captchaTokenField form field and cookie name containing the sealed
+	// captcha token in stateless mode.
+	captchaTokenField = "captcha_token"
+	// captchaTokenHeader response header of the image containing the token.
+	captchaTokenHeader = "X-Captcha-Token"
+)
+
+var errCaptchaUsed = errors.New("Captcha already used. Please reload the image")
+
+// captchaAAD and captchaQuestionAAD additional authenticated data to bind the
+// token to its purpose. A token of the image cannot answer a question and vice
+// versa.
+var (
+	captchaAAD         = []byte("mailout captcha")
+	captchaQuestionAAD = []byte("mailout captcha question")
+)
+
+// captchaSealer seals the hash of the solution and the expiry time into an
+// encrypted and authenticated token. Every instance sharing the same key can
+// verify the token without a shared session store.
+type captchaSealer struct {
+	aead       cipher.AEAD
+	aad        []byte
+	ignoreCase bool
+	replay     replayStore
+	now        func() time.Time
+}
+
+// newCaptchaSealer creates an AES-GCM sealer. The key must have 16, 24 or 32
+// bytes.
+func newCaptchaSealer(key []byte, ignoreCase bool, now func() time.Time) (*captchaSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &captchaSealer{
+		aead:       aead,
+		aad:        captchaAAD,
+		ignoreCase: ignoreCase,
+		replay:     newReplayCache(),
+		now:        now,
+	}, nil
+}
+
+// seal returns the token for the solutions which expires at exp. Any of the
+// solutions will be accepted.
+func (cs *captchaSealer) seal(exp time.Time, answers ...string) string {
+	payload := make([]byte, 8, 8+sha256.Size*len(answers))
+	binary.BigEndian.PutUint64(payload, uint64(exp.Unix()))
+	for _, a := range answers {
+		payload = append(payload, cs.hash(a)...)
+	}
+
+	nonce := randomKey(cs.aead.NonceSize())
+	sealed := cs.aead.Seal(nonce, nonce, payload, cs.aad)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// open verifies the token and compares the text with the sealed solutions.
+// Each token can only be used once, regardless if the text is correct.
+func (cs *captchaSealer) open(token, text string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	ns := cs.aead.NonceSize()
+	if err != nil || len(raw) < ns {
+		return errCaptchaWrong
+	}
+	payload, err := cs.aead.Open(nil, raw[:ns], raw[ns:], cs.aad)
+	if err != nil || len(payload) <= 8 || (len(payload)-8)%sha256.Size != 0 {
+		return errCaptchaWrong
+	}
+	exp := int64(binary.BigEndian.Uint64(payload))
+	if cs.now().Unix() > exp {
+		return errCaptchaExpired
+	}
+	if cs.replay.seen(string(raw[:ns]), exp, cs.now().Unix()) {
+		return errCaptchaUsed
+	}
+	h := cs.hash(text)
+	for p := payload[8:]; len(p) > 0; p = p[sha256.Size:] {
+		if subtle.ConstantTimeCompare(p[:sha256.Size], h) == 1 {
+			return nil
+		}
+	}
+	return errCaptchaWrong
+}
+
+func (cs *captchaSealer) hash(answer string) []byte {
+	answer = strings.TrimSpace(answer)
+	if cs.ignoreCase {
+		answer = strings.ToLower(answer)
+	}
+	h := sha256.Sum256([]byte(answer))
+	return h[:]
+}
+
+// tokenFromRequest returns the token from the form field or the cookie.
+func tokenFromRequest(r *http.Request) string {
+	if t := r.PostFormValue(captchaTokenField); t != "" {
+		return t
+	}
+	if c, err := r.Cookie(captchaTokenField); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// replayStore remembers used tokens until they expire.
+type replayStore interface {
+	// seen marks the id as used and returns true if it has already been
+	// used.
+	seen(id string, exp, now int64) bool
+}
+
+// replayCache remembers used tokens in the memory of the process. It is not
+// shared between instances, see replayDir.
+type replayCache struct {
+	mu        sync.Mutex
+	used      map[string]int64
+	nextPrune int64
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		used: make(map[string]int64),
+	}
+}
+
+// seen marks the id as used and returns true if it has already been used.
+// Expired ids get removed at most once per minute.
+func (rc *replayCache) seen(id string, exp, now int64) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if now >= rc.nextPrune {
+		for k, e := range rc.used {
+			if now > e {
+				delete(rc.used, k)
+			}
+		}
+		rc.nextPrune = now + 60
+	}
+	if _, ok := rc.used[id]; ok {
+		return true
+	}
+	rc.used[id] = exp
+	return false
+}
+
+// replayDir remembers used tokens as files in a directory shared by all
+// instances, e.g. a network file system. Creating the file with O_EXCL is
+// atomic, so each token can be used only once across the instances.
+type replayDir struct {
+	dir       string
+	mu        sync.Mutex
+	nextPrune int64
+}
+
+func newReplayDir(dir string) *replayDir {
+	return &replayDir{dir: dir}
+}
+
+// seen creates a file named by the id whose modification time is the expiry
+// time. Returns true if the file already exists or cannot be created, so a
+// broken share rejects the tokens instead of allowing replays. Expired files
+// get removed at most once per minute.
+func (rd *replayDir) seen(id string, exp, now int64) bool {
+	rd.prune(now)
+	name := filepath.Join(rd.dir, hex.EncodeToString([]byte(id)))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return true
+	}
+	if err := f.Close(); err != nil {
+		return true
+	}
+	_ = os.Chtimes(name, time.Unix(exp, 0), time.Unix(exp, 0))
+	return false
+}
+
+func (rd *replayDir) prune(now int64) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if now < rd.nextPrune {
+		return
+	}
+	rd.nextPrune = now + 60
+	entries, err := os.ReadDir(rd.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() && now > fi.ModTime().Unix() {
+			_ = os.Remove(filepath.Join(rd.dir, e.Name()))
+		}
+	}
+}
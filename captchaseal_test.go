@@ -0,0 +1,152 @@
+package mailout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptchaSealer(t *testing.T) {
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	cs, err := newCaptchaSealer([]byte("0123456789abcdef"), false, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCaptchaSealer([]byte("fedcba9876543210"), false, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := cs.seal(now.Add(time.Minute), "AbC12")
+	assert.NotContains(t, token, "AbC12")
+
+	assert.Exactly(t, errCaptchaWrong, cs.open("", "AbC12"))
+	assert.Exactly(t, errCaptchaWrong, cs.open("not-base64!", "AbC12"))
+	assert.Exactly(t, errCaptchaWrong, other.open(token, "AbC12"), "different key")
+	tampered := []byte(token)
+	tampered[len(tampered)-3] ^= 1
+	assert.Exactly(t, errCaptchaWrong, cs.open(string(tampered), "AbC12"))
+
+	assert.Exactly(t, errCaptchaWrong, cs.open(cs.seal(now.Add(time.Minute), "AbC12"), "abc12"))
+	assert.NoError(t, cs.open(token, " AbC12 "))
+	assert.Exactly(t, errCaptchaUsed, cs.open(token, "AbC12"))
+
+	expired := cs.seal(now.Add(-time.Second), "AbC12")
+	assert.Exactly(t, errCaptchaExpired, cs.open(expired, "AbC12"))
+
+	cs.ignoreCase = true
+	assert.NoError(t, cs.open(cs.seal(now.Add(time.Minute), "AbC12"), "abc12"))
+
+	multi := cs.seal(now.Add(time.Minute), "AbC12", "10")
+	assert.NoError(t, cs.open(multi, "10"))
+}
+
+func TestReplayCache(t *testing.T) {
+	rc := newReplayCache()
+	assert.False(t, rc.seen("a", 100, 10))
+	assert.True(t, rc.seen("a", 100, 20))
+	assert.False(t, rc.seen("b", 50, 30))
+	assert.Len(t, rc.used, 2)
+	// prune after one minute removes the expired entry b
+	assert.False(t, rc.seen("c", 200, 75))
+	assert.Len(t, rc.used, 2)
+	assert.True(t, rc.seen("a", 100, 80))
+}
+
+func TestReplayDir(t *testing.T) {
+	dir := t.TempDir()
+	rd := newReplayDir(dir)
+	assert.False(t, rd.seen("a", 100, 10))
+	assert.True(t, rd.seen("a", 100, 20))
+	// another instance sharing the directory
+	assert.True(t, newReplayDir(dir).seen("a", 100, 20))
+	assert.False(t, rd.seen("b", 50, 30))
+	// prune after one minute removes the expired entry b
+	assert.False(t, rd.seen("c", 200, 75))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 2)
+	assert.True(t, rd.seen("a", 100, 80))
+
+	// fails closed
+	assert.True(t, newReplayDir(filepath.Join(dir, "missing")).seen("d", 100, 10))
+}
+
+func TestServeHTTP_CaptchaStateless(t *testing.T) {
+
+	caddyFile := `mailout {
+		captcha
+		captcha_stateless
+		captcha_replay_dir     ` + t.TempDir() + `
+		captcha_encryption_key 0123456789abcdef0123456789abcdef
+	}`
+	// two instances behind a load balancer
+	node1 := newTestHandler(t, caddyFile)
+	node2 := newTestHandler(t, caddyFile)
+
+	rec := httptest.NewRecorder()
+	if _, err := node1.ServeHTTP(rec, httptest.NewRequest("GET", "/mailout/captcha", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, headerPNG, rec.Header().Get(headerContentType))
+	token := rec.Header().Get(captchaTokenHeader)
+	assert.NotEmpty(t, token)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	assert.Exactly(t, captchaTokenField, cookies[0].Name)
+	assert.Exactly(t, token, cookies[0].Value)
+	assert.True(t, cookies[0].HttpOnly)
+
+	post := func(h *handler, token, text string, useCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{
+			"email":      []string{"ken@thompson.email"},
+			captchaField: []string{text},
+		}
+		if useCookie {
+			req.AddCookie(&http.Cookie{Name: captchaTokenField, Value: token})
+		} else {
+			req.PostForm.Set(captchaTokenField, token)
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// the image contains an unknown solution, so seal a known one with the
+	// key of node1 and verify it on node2.
+	token = node1.captcha.sealer.seal(time.Now().Add(time.Minute), "gopher")
+
+	w := post(node2, token, "gopher", true)
+	assert.Exactly(t, http.StatusOK, w.Code)
+
+	// replay on the same node and on the other node
+	w = post(node2, token, "gopher", false)
+	assert.Exactly(t, http.StatusUnauthorized, w.Code)
+	assert.Exactly(t, "{\"code\":401,\"error\":\"Captcha already used. Please reload the image\"}\n", w.Body.String())
+	w = post(node1, token, "gopher", false)
+	assert.Exactly(t, http.StatusUnauthorized, w.Code)
+	assert.Exactly(t, "{\"code\":401,\"error\":\"Captcha already used. Please reload the image\"}\n", w.Body.String())
+
+	// a wrong answer burns the token
+	token = node2.captcha.sealer.seal(time.Now().Add(time.Minute), "gopher")
+	w = post(node1, token, "wrong", false)
+	assert.Exactly(t, http.StatusUnauthorized, w.Code)
+	assert.Exactly(t, "{\"code\":401,\"error\":\"Wrong captcha_text\"}\n", w.Body.String())
+	w = post(node1, token, "gopher", false)
+	assert.Exactly(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,105 @@
+package mailout
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize size of the chunks sent with the INSTREAM command.
+const clamdChunkSize = 64 << 10
+
+// clamdClient scans data with the INSTREAM command of the ClamAV daemon via
+// TCP or a Unix socket.
+type clamdClient struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// newClamdClient creates a new client. See socketAddr for the address format.
+func newClamdClient(addr string, timeout time.Duration) *clamdClient {
+	cc := &clamdClient{
+		timeout: timeout,
+	}
+	cc.network, cc.addr = socketAddr(addr)
+	return cc
+}
+
+// scan streams data to clamd. Returns the name of the signature if clamd
+// found a virus and an empty string if the data is clean.
+func (cc *clamdClient) scan(data []byte) (virus string, err error) {
+	conn, err := net.DialTimeout(cc.network, cc.addr, cc.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(cc.timeout)); err != nil {
+		return "", err
+	}
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > clamdChunkSize {
+			n = clamdChunkSize
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		bw.Write(size[:])
+		bw.Write(data[:n])
+		data = data[n:]
+	}
+	// a chunk of length zero terminates the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	bw.Write(size[:])
+	if err = bw.Flush(); err != nil {
+		return "", err
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && resp == "" {
+		return "", fmt.Errorf("clamd: cannot read response: %s", err)
+	}
+	return parseClamdResponse(strings.TrimRight(resp, "\x00\n"))
+}
+
+// parseClamdResponse parses e.g.:
+//
+//	stream: OK
+//	stream: Eicar-Test-Signature FOUND
+//	INSTREAM size limit exceeded. ERROR
+func parseClamdResponse(resp string) (virus string, err error) {
+	resp = strings.TrimPrefix(resp, "stream: ")
+	switch {
+	case resp == "OK":
+		return "", nil
+	case strings.HasSuffix(resp, " FOUND"):
+		return strings.TrimSuffix(resp, " FOUND"), nil
+	case strings.HasSuffix(resp, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(resp, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: malformed response %q", resp)
+}
+
+// scanUploads scans all files. Returns an uploadError if a file is infected
+// or clamd cannot be reached, because unscanned files must not be sent.
+func (cc *clamdClient) scanUploads(ups []upload, errorf func(format string, v ...interface{})) error {
+	for _, u := range ups {
+		virus, err := cc.scan(u.data)
+		if err != nil {
+			errorf("[mailout] %s", err)
+			return newUploadError(http.StatusServiceUnavailable, "", errCodeVirusScanUnavailable, "Virus scan unavailable")
+		}
+		if virus != "" {
+			errorf("[mailout] clamd found %s in file %q", virus, u.name)
+			return newUploadError(StatusUnprocessableEntity, u.field, errCodeVirusFound, "File %q contains a virus: %s", u.name, virus)
+		}
+	}
+	return nil
+}
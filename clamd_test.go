@@ -0,0 +1,177 @@
+package mailout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar the anti virus test file, detected by every scanner.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM requests and reports the EICAR string as virus.
+// maxStream emulates the StreamMaxLength of clamd.
+type fakeClamd struct {
+	ln        net.Listener
+	maxStream int
+}
+
+func newFakeClamd(t *testing.T, network, addr string) *fakeClamd {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &fakeClamd{ln: ln, maxStream: 1 << 20}
+	go fc.serve()
+	return fc
+}
+
+func (fc *fakeClamd) serve() {
+	for {
+		conn, err := fc.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fc.handle(conn)
+	}
+}
+
+func (fc *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	cmd, err := br.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var data []byte
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+	if len(data) > fc.maxStream {
+		io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+		return
+	}
+	if bytes.Contains(data, []byte(eicar)) {
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+		return
+	}
+	io.WriteString(conn, "stream: OK\x00")
+}
+
+func TestClamdClient_Scan(t *testing.T) {
+	tcp := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	defer tcp.ln.Close()
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	unix := newFakeClamd(t, "unix", sock)
+	defer unix.ln.Close()
+
+	// the EICAR string split across two chunks
+	large := append(bytes.Repeat([]byte{'a'}, clamdChunkSize-10), eicar...)
+
+	tests := []struct {
+		addr      string
+		data      []byte
+		wantVirus string
+		wantErr   string
+	}{
+		{tcp.ln.Addr().String(), testPDF, "", ""},
+		{tcp.ln.Addr().String(), []byte(eicar), "Eicar-Test-Signature", ""},
+		{tcp.ln.Addr().String(), large, "Eicar-Test-Signature", ""},
+		{tcp.ln.Addr().String(), bytes.Repeat([]byte{'a'}, 2<<20), "", "clamd: INSTREAM size limit exceeded."},
+		{"unix:" + sock, []byte(eicar), "Eicar-Test-Signature", ""},
+		{sock, testPNG, "", ""},
+	}
+	for i, test := range tests {
+		virus, err := newClamdClient(test.addr, time.Second).scan(test.data)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantVirus, virus, "Index %d", i)
+	}
+}
+
+func TestParseClamdResponse(t *testing.T) {
+	tests := []struct {
+		resp      string
+		wantVirus string
+		wantErr   string
+	}{
+		{"stream: OK", "", ""},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1", ""},
+		{"INSTREAM size limit exceeded. ERROR", "", "clamd: INSTREAM size limit exceeded."},
+		{"UNKNOWN COMMAND", "", `clamd: malformed response "UNKNOWN COMMAND"`},
+	}
+	for i, test := range tests {
+		virus, err := parseClamdResponse(test.resp)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantVirus, virus, "Index %d", i)
+	}
+}
+
+func TestServeHTTP_Clamd(t *testing.T) {
+	fc := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	defer fc.ln.Close()
+
+	// closed listener to simulate a clamd which is down
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	tests := []struct {
+		addr     string
+		file     testFile
+		wantCode int
+		wantBody string
+	}{
+		{fc.ln.Addr().String(), testFile{"cv", "cv.pdf", testPDF}, http.StatusOK, `{"version":2,"code":200}`},
+		{fc.ln.Addr().String(), testFile{"cv", "eicar.txt", []byte(eicar)}, StatusUnprocessableEntity,
+			`{"version":2,"code":422,"error":"File \"eicar.txt\" contains a virus: Eicar-Test-Signature","error_code":"virus_found","fields":{"cv":["File \"eicar.txt\" contains a virus: Eicar-Test-Signature"]}}`},
+		{down.Addr().String(), testFile{"cv", "cv.pdf", testPDF}, http.StatusServiceUnavailable,
+			`{"version":2,"code":503,"error":"Virus scan unavailable","error_code":"virus_scan_unavailable"}`},
+	}
+	for i, test := range tests {
+		h := newTestHandler(t, `mailout {
+			upload_max_files 1
+			upload_types     application/pdf text/plain
+			clamd            `+test.addr+`
+			clamd_timeout    1s
+		}`)
+		req := newMultipartRequest(t, map[string]string{"email": "ken@thompson.email"}, test.file)
+		req.Header.Set("Accept", headerApplicationJSONV2)
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, req)
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+	}
+}
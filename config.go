@@ -6,7 +6,9 @@ import (
 	htpl "html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -84,6 +86,27 @@ type config struct {
 	// bodyTpl parsed and loaded HTML or Text template for the email body.
 	bodyTpl renderer
 
+	// autoreplyBody path/to/tpl.[txt|html] of the confirmation email to the
+	// submitter. Empty disables the autoreply.
+	autoreplyBody       string
+	autoreplyBodyIsHTML bool
+	autoreplyBodyTpl    renderer
+	autoreplySubject    string
+	autoreplySubjectTpl *ttpl.Template
+	// autoreplyFromEmail and autoreplyFromName sender of the autoreply.
+	// Defaults to fromEmail and fromName.
+	autoreplyFromEmail string
+	autoreplyFromName  string
+	// autoreplyInterval minimum duration between two autoreplies to the same
+	// address.
+	autoreplyInterval time.Duration
+	// autoreplyMax maximum number of autoreplies to all addresses together
+	// per autoreplyInterval. 0 disables the limit.
+	autoreplyMax int
+	// autoreplyFields patterns of the form fields available in the autoreply
+	// templates. Empty hides all fields.
+	autoreplyFields []string
+
 	//username        [ENV:MY_SMTP_USERNAME|gopher]
 	username string
 	//password        [ENV:MY_SMTP_PASSWORD|g0ph3r]
@@ -100,15 +123,184 @@ type config struct {
 	// specify form field used for redirect urls
 	redirectField string
 
+	// honeypotField name of a hidden form field which must stay empty. If a
+	// bot fills it out, the submission gets silently dropped.
+	honeypotField string
+
+	// enable the time trap. Each submission must contain a signed token
+	// issued by the route {endpoint}/token.
+	timeTrap bool
+	// timeTrapSecret [ENV:MY_TIMETRAP_SECRET|s3cr3t] HMAC key to sign the
+	// tokens. If empty a random key gets generated on start up.
+	timeTrapSecret string
+	// timeTrapMinAge minimum duration a human needs to fill out the form.
+	timeTrapMinAge time.Duration
+	// timeTrapMaxAge maximum age of a token.
+	timeTrapMaxAge time.Duration
+
+	// enable CSRF protection with a double submit cookie issued by the route
+	// {endpoint}/csrf.
+	csrf bool
+	// csrfSecret [ENV:MY_CSRF_SECRET|s3cr3t] HMAC key to sign the tokens. If
+	// empty a random key gets generated on start up.
+	csrfSecret string
+
+	// fields schema of the form fields, declared with the field sub-directive.
+	fields []*formField
+	// fieldsAllow and fieldsDeny glob patterns of the form fields visible in
+	// the templates. If fieldsAllow is not empty only matching fields are
+	// visible.
+	fieldsAllow []string
+	fieldsDeny  []string
+
+	// emailAllow, emailBlock and emailDisposable restrict the email field.
+	// emailBlock contains domains and addresses. emailDisposable is a path to
+	// a file with one domain per line.
+	emailAllow      []string
+	emailBlock      []string
+	emailDisposable string
+	// emailPolicy loaded during setup. Nil if disabled.
+	emailPolicy *emailPolicy
+	// emailDNSCheck verifies the MX, A or AAAA records of the email domain.
+	emailDNSCheck    bool
+	emailDNSTimeout  time.Duration
+	emailDNSCacheTTL time.Duration
+
+	// maxBodySize in bytes of url encoded and JSON bodies. Multipart bodies
+	// may contain additionally uploadMaxTotalSize bytes.
+	maxBodySize int64
+	// maxFields number of form values. 0 disables the check.
+	maxFields int
+	// maxFieldLength in characters of a form value. 0 disables the check.
+	maxFieldLength int
+
+	// idempotency suppresses duplicate submissions within idempotencyWindow.
+	// Duplicates are detected by the Idempotency-Key header or the content.
+	idempotency       bool
+	idempotencyWindow time.Duration
+
+	// uploadMaxFiles number of files a multipart request may contain. 0
+	// disables file uploads.
+	uploadMaxFiles int
+	// uploadMaxFileSize and uploadMaxTotalSize in bytes.
+	uploadMaxFileSize  int64
+	uploadMaxTotalSize int64
+	// uploadTypes allowed media types, detected by sniffing the content.
+	uploadTypes []string
+	// clamdAddr address of the ClamAV daemon to scan the uploads. host:port
+	// or a path to a Unix socket. Empty disables the scan.
+	clamdAddr    string
+	clamdTimeout time.Duration
+
+	// blockIPs and allowIPs contain IP addresses, CIDR ranges or paths to
+	// files with one entry per line.
+	blockIPs []string
+	allowIPs []string
+
+	// allowedOrigins list of origins which are allowed to post to the
+	// endpoint. Enables the CORS handling. Empty disables the Origin check.
+	allowedOrigins []string
+
 	// enable captcha
 	Captcha bool
+	// captchaWidth and captchaHeight of the image in pixel
+	captchaWidth  int
+	captchaHeight int
+	// captchaLength number of characters
+	captchaLength int
+	// captchaCharset characters used to generate the text
+	captchaCharset string
+	// captchaNoise density of the noise, captchaCurves number of curves
+	captchaNoise  float64
+	captchaCurves int
+	// captchaIgnoreCase compares the text case insensitive
+	captchaIgnoreCase bool
+	// captchaTTL duration a captcha can be solved
+	captchaTTL time.Duration
+	// captchaMaxAttempts number of wrong answers until the captcha expires
+	captchaMaxAttempts int
+	// captchaAuthKey [ENV:MY_CAPTCHA_AUTH_KEY|s3cr3t] signs the session
+	// cookie. If empty a random key gets generated on start up.
+	captchaAuthKey string
+	// captchaEncKey [ENV:MY_CAPTCHA_ENC_KEY|s3cr3t] encrypts the session
+	// cookie. Must have 16, 24 or 32 bytes. If empty a random key gets
+	// generated on start up.
+	captchaEncKey string
+	// captchaStateless seals the solution into an encrypted token instead of
+	// storing it in the in memory session. Required for multiple instances.
+	captchaStateless bool
+	// captchaReplayDir directory shared by all instances to remember the used
+	// tokens. Required by captchaStateless. Empty uses an in memory cache.
+	captchaReplayDir string
+	// captchaJSON enables the route {endpoint}/captcha.json
+	captchaJSON bool
+	// captchaQuestions text questions of the JSON captcha as accessible
+	// alternative to the image.
+	captchaQuestions []captchaQuestion
 
 	// enable recaptcha
 	ReCaptcha       bool
 	ReCaptchaSecret string
 
+	// captchaProvider name of the third party captcha service: recaptcha,
+	// recaptcha_v3, hcaptcha, turnstile or custom.
+	captchaProvider string
+	// captchaSecret [ENV:MY_CAPTCHA_SECRET|s3cr3t] secret key of the site.
+	captchaSecret string
+	// captchaVerifyURL overwrites the default siteverify URL of the provider.
+	captchaVerifyURL string
+	// captchaField overwrites the default form field of the provider.
+	captchaField string
+	// captchaHostnames allowed hostnames in the verification response. If
+	// empty the host of the request must match.
+	captchaHostnames []string
+	// captchaMaxAge maximum age of a solved challenge.
+	captchaMaxAge time.Duration
+	// captchaMinScore minimum score for reCAPTCHA v3.
+	captchaMinScore float64
+	// captchaAction expected action for reCAPTCHA v3. Empty skips the check.
+	captchaAction string
+
 	rateLimitInterval time.Duration
 	rateLimitCapacity int64
+
+	// enable the proof of work challenge issued by the route {endpoint}/pow
+	pow bool
+	// powSecret [ENV:MY_POW_SECRET|s3cr3t] HMAC key to sign the challenges.
+	// If empty a random key gets generated on start up.
+	powSecret string
+	// powDifficulty number of leading zero bits of the hash.
+	powDifficulty int
+	// powMaxDifficulty upper limit of the difficulty under load.
+	powMaxDifficulty int
+	// powThreshold number of challenges per minute after which the
+	// difficulty rises. 0 disables the rise.
+	powThreshold int
+	// powTTL duration to solve a challenge.
+	powTTL time.Duration
+
+	// spamRulesFile path to the JSON file containing the spam rules.
+	spamRulesFile string
+	// spamRules loaded during setup. Nil if disabled.
+	spamRules *spamRules
+
+	// bayesHamDir and bayesSpamDir contain the example submissions to train
+	// the Bayes classifier.
+	bayesHamDir  string
+	bayesSpamDir string
+	// bayesAdminToken enables the route to mark submissions as spam or ham.
+	bayesAdminToken string
+	// bayes loaded during setup. Nil if disabled.
+	bayes *bayesClassifier
+
+	// spamdAddr address of the SpamAssassin spamd daemon. host:port or a path
+	// to a Unix socket. Empty disables the check.
+	spamdAddr    string
+	spamdTimeout time.Duration
+	// spamdTag score to tag the subject. 0 uses the verdict of spamd.
+	spamdTag float64
+	// spamdReject score to not send the email. 0 disables it.
+	spamdReject float64
 }
 
 func newConfig() *config {
@@ -120,6 +312,40 @@ func newConfig() *config {
 		port:              1025, // mailhog (github.com/mailhog/MailHog) default port
 		rateLimitInterval: time.Hour * 24,
 		rateLimitCapacity: 1000,
+		timeTrapMinAge:    time.Second * 3,
+		timeTrapMaxAge:    time.Hour * 2,
+		captchaMaxAge:     time.Minute * 10,
+		captchaMinScore:   0.5,
+
+		captchaWidth:       150,
+		captchaHeight:      60,
+		captchaLength:      5,
+		captchaCharset:     defaultCaptchaCharset,
+		captchaNoise:       1,
+		captchaCurves:      1,
+		captchaTTL:         time.Minute * 10,
+		captchaMaxAttempts: 3,
+
+		powDifficulty:    18,
+		powMaxDifficulty: 22,
+		powTTL:           time.Minute * 10,
+
+		spamdTimeout: time.Second * 10,
+
+		emailDNSTimeout:  time.Second * 3,
+		emailDNSCacheTTL: time.Hour,
+
+		autoreplySubject:  "Thank you for your message",
+		autoreplyInterval: time.Hour,
+		autoreplyMax:      100,
+
+		maxBodySize:       1 << 20,
+		idempotencyWindow: time.Minute * 10,
+
+		uploadMaxFileSize:  5 << 20,
+		uploadMaxTotalSize: 10 << 20,
+		uploadTypes:        []string{"application/pdf", "image/jpeg", "image/png", "image/gif"},
+		clamdTimeout:       time.Second * 30,
 	}
 }
 
@@ -221,6 +447,20 @@ func (c *config) loadFromEnv() error {
 	c.username = loadFromEnv(c.username)
 	c.password = loadFromEnv(c.password)
 	c.host = loadFromEnv(c.host)
+	c.timeTrapSecret = loadFromEnv(c.timeTrapSecret)
+	c.csrfSecret = loadFromEnv(c.csrfSecret)
+	c.ReCaptchaSecret = loadFromEnv(c.ReCaptchaSecret)
+	c.captchaSecret = loadFromEnv(c.captchaSecret)
+	c.powSecret = loadFromEnv(c.powSecret)
+	c.captchaAuthKey = loadFromEnv(c.captchaAuthKey)
+	c.captchaEncKey = loadFromEnv(c.captchaEncKey)
+	c.bayesAdminToken = loadFromEnv(c.bayesAdminToken)
+	if l := len(c.captchaEncKey); l != 0 && l != 16 && l != 24 && l != 32 {
+		return fmt.Errorf("[mailout] captcha_encryption_key must have 16, 24 or 32 bytes. Have: %d", l)
+	}
+	if c.captchaStateless && c.captchaEncKey == "" {
+		return fmt.Errorf("[mailout] captcha_stateless requires the same captcha_encryption_key on all instances")
+	}
 	c.portRaw = loadFromEnv(c.portRaw)
 	c.port, err = strconv.Atoi(c.portRaw)
 	return err
@@ -237,27 +477,200 @@ func (c *config) pingSMTP() error {
 }
 
 func (c *config) loadTemplate() (err error) {
-	if !fileExists(c.body) {
-		return fmt.Errorf("[mailout] File %q not found", c.body)
+	if c.bodyTpl, c.bodyIsHTML, err = parseBodyTemplate(c.body); err != nil {
+		return
+	}
+	if c.subjectTpl, err = ttpl.New("").Parse(c.subject); err != nil {
+		return
+	}
+
+	if c.autoreplyBody == "" {
+		return nil
+	}
+	if c.autoreplyBodyTpl, c.autoreplyBodyIsHTML, err = parseBodyTemplate(c.autoreplyBody); err != nil {
+		return
+	}
+	c.autoreplySubjectTpl, err = ttpl.New("").Parse(c.autoreplySubject)
+	return
+}
+
+// parseBodyTemplate parses an email body template. The suffix of the file
+// name selects the text or the HTML template engine.
+func parseBodyTemplate(file string) (renderer, bool, error) {
+	if !fileExists(file) {
+		return nil, false, fmt.Errorf("[mailout] File %q not found", file)
 	}
 
-	switch filepath.Ext(c.body) {
+	var tpl renderer
+	var err error
+	isHTML := false
+	switch filepath.Ext(file) {
 	case ".txt":
-		c.bodyTpl, err = ttpl.ParseFiles(c.body)
+		tpl, err = ttpl.ParseFiles(file)
 	case ".html":
-		c.bodyIsHTML = true
-		c.bodyTpl, err = htpl.ParseFiles(c.body)
+		isHTML = true
+		tpl, err = htpl.ParseFiles(file)
 	default:
-		return fmt.Errorf("[mailout] Incorrect file extension. Neither .txt nor .html: %q", c.body)
+		return nil, false, fmt.Errorf("[mailout] Incorrect file extension. Neither .txt nor .html: %q", file)
 	}
 	if err != nil {
-		return fmt.Errorf("[mailout] File %q not readable: %s", c.body, err)
+		return nil, false, fmt.Errorf("[mailout] File %q not readable: %s", file, err)
+	}
+	return tpl, isHTML, nil
+}
+
+func (c *config) loadBayes() (err error) {
+	if c.bayesHamDir == "" {
+		return nil
 	}
+	c.bayes, err = newBayesClassifier(c.bayesHamDir, c.bayesSpamDir)
+	return
+}
 
-	c.subjectTpl, err = ttpl.New("").Parse(c.subject)
+func (c *config) loadEmailPolicy() (err error) {
+	c.emailPolicy, err = newEmailPolicy(c.emailAllow, c.emailBlock, c.emailDisposable)
+	return
+}
+
+func (c *config) loadSpamRules() (err error) {
+	if c.spamRulesFile == "" {
+		return nil
+	}
+	c.spamRules, err = loadSpamRules(c.spamRulesFile, c.bayes)
 	return
 }
 
+// spamTagPrefix returns the prefix for the subject of tagged emails.
+func (c *config) spamTagPrefix() string {
+	if c.spamRules != nil {
+		return c.spamRules.TagPrefix
+	}
+	return defaultSpamTag
+}
+
+// captchaProviderField returns the form field of the configured captcha
+// provider or an empty string.
+func (c *config) captchaProviderField() string {
+	if c.captchaField != "" {
+		return c.captchaField
+	}
+	name := c.captchaProvider
+	if name == "" && c.ReCaptcha {
+		name = providerReCaptcha
+	}
+	return providerDefaults[name].field
+}
+
+// internalFields returns the names of the form fields used by mailout itself,
+// e.g. for tokens and captchas. They are not part of the message.
+func (c *config) internalFields() []string {
+	fields := []string{
+		captchaField, captchaIDField, captchaQuestionIDField, captchaTokenField, csrfField,
+		timeTrapField, powChallengeField, powSolutionField,
+	}
+	for _, f := range [...]string{c.captchaProviderField(), c.honeypotField, c.redirectField} {
+		if f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// templateForm returns a copy of the form without the internal fields and
+// filtered by fieldsAllow and fieldsDeny.
+func (c *config) templateForm(form url.Values) url.Values {
+	internal := c.internalFields()
+	ret := make(url.Values, len(form))
+	for k, v := range form {
+		if c.isTemplateField(internal, k) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// autoreplyForm returns the fields of templateForm which match autoreplyFields.
+func (c *config) autoreplyForm(form url.Values) url.Values {
+	ret := make(url.Values)
+	for k, v := range c.templateForm(form) {
+		if matchFieldPattern(c.autoreplyFields, k) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// isTemplateField returns false for internal fields and fields hidden by
+// fieldsAllow and fieldsDeny.
+func (c *config) isTemplateField(internal []string, name string) bool {
+	if containsString(internal, name) || matchFieldPattern(c.fieldsDeny, name) {
+		return false
+	}
+	return len(c.fieldsAllow) == 0 || matchFieldPattern(c.fieldsAllow, name)
+}
+
+// templateJSON returns a copy of the decoded JSON body which contains only the
+// values whose flattened field name is visible in templateForm. Objects and
+// arrays which end up empty get removed.
+func (c *config) templateJSON(data interface{}) interface{} {
+	if data == nil {
+		return nil
+	}
+	v, _ := c.filterJSON(c.internalFields(), "", data)
+	return v
+}
+
+// filterJSON uses the same keys as flattenJSON.
+func (c *config) filterJSON(internal []string, key string, v interface{}) (interface{}, bool) {
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(vt))
+		for k, child := range vt {
+			ck := k
+			if key != "" {
+				ck = key + "." + k
+			}
+			if fv, ok := c.filterJSON(internal, ck, child); ok {
+				ret[k] = fv
+			}
+		}
+		return ret, key == "" || len(ret) > 0
+	case []interface{}:
+		// filtered elements get replaced with an empty value, so the
+		// positions still match the flattened keys of .Form.
+		ret := make([]interface{}, len(vt))
+		kept := false
+		for i, child := range vt {
+			ck := key
+			var empty interface{}
+			switch child.(type) {
+			case map[string]interface{}:
+				ck, empty = key+"."+strconv.Itoa(i), map[string]interface{}{}
+			case []interface{}:
+				ck, empty = key+"."+strconv.Itoa(i), []interface{}{}
+			}
+			if fv, ok := c.filterJSON(internal, ck, child); ok {
+				ret[i], kept = fv, true
+			} else {
+				ret[i] = empty
+			}
+		}
+		return ret, kept
+	}
+	return v, c.isTemplateField(internal, key)
+}
+
+// matchFieldPattern returns true if the name matches one of the glob patterns.
+// The patterns have been validated during parsing.
+func matchFieldPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func loadFromEnv(s string) string {
 	const envPrefix = `ENV:`
 	if strings.Index(s, envPrefix) != 0 {
@@ -271,6 +271,26 @@ func TestLoadFromEnv(t *testing.T) {
 	assert.Exactly(t, wantConfig, mc)
 }
 
+func TestLoadFromEnv_CaptchaEncryptionKey(t *testing.T) {
+
+	if err := os.Setenv("MAILOUT_CAPTCHA_ENC_KEY", "tooShort"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("MAILOUT_CAPTCHA_ENC_KEY")
+
+	c := newConfig()
+	c.portRaw = "25"
+	c.captchaEncKey = "ENV:MAILOUT_CAPTCHA_ENC_KEY"
+	assert.EqualError(t, c.loadFromEnv(), "[mailout] captcha_encryption_key must have 16, 24 or 32 bytes. Have: 8")
+
+	c.captchaEncKey = "0123456789abcdef"
+	assert.NoError(t, c.loadFromEnv())
+
+	c.captchaStateless = true
+	c.captchaEncKey = ""
+	assert.EqualError(t, c.loadFromEnv(), "[mailout] captcha_stateless requires the same captcha_encryption_key on all instances")
+}
+
 func TestLoadTemplate(t *testing.T) {
 
 	tests := []struct {
@@ -341,3 +361,91 @@ func TestPingSMTP_Fail(t *testing.T) {
 	c.port = 4711
 	assert.EqualError(t, c.pingSMTP(), "dial tcp [::1]:4711: getsockopt: connection refused")
 }
+
+func TestTemplateForm(t *testing.T) {
+	form := url.Values{
+		"name":                 {"Ken"},
+		"email":                {"ken@thompson.email"},
+		"address.city":         {"Berkeley"},
+		"address.zip":          {"94720"},
+		"internal_note":        {"secret"},
+		"g-recaptcha-response": {"token"},
+		csrfField:              {"token"},
+		"website":              {""},
+		"redirect":             {"https://example.com"},
+	}
+
+	tests := []struct {
+		allow, deny []string
+		want        url.Values
+	}{
+		{nil, nil, url.Values{"name": {"Ken"}, "email": {"ken@thompson.email"}, "address.city": {"Berkeley"}, "address.zip": {"94720"}, "internal_note": {"secret"}}},
+		{nil, []string{"internal_*", "address.zip"}, url.Values{"name": {"Ken"}, "email": {"ken@thompson.email"}, "address.city": {"Berkeley"}}},
+		{[]string{"name", "address.*"}, nil, url.Values{"name": {"Ken"}, "address.city": {"Berkeley"}, "address.zip": {"94720"}}},
+		{[]string{"name", "address.*", csrfField}, []string{"address.zip"}, url.Values{"name": {"Ken"}, "address.city": {"Berkeley"}}},
+	}
+	for i, test := range tests {
+		mc := newConfig()
+		mc.ReCaptcha = true
+		mc.honeypotField = "website"
+		mc.redirectField = "redirect"
+		mc.fieldsAllow = test.allow
+		mc.fieldsDeny = test.deny
+		assert.Exactly(t, test.want, mc.templateForm(form), "Index %d", i)
+	}
+}
+
+func TestTemplateJSON(t *testing.T) {
+	data := map[string]interface{}{
+		"name":    "Ken",
+		"email":   "ken@thompson.email",
+		"address": map[string]interface{}{"city": "Berkeley", "zip": "94720"},
+		"tags":    []interface{}{"unix", "go"},
+		"items": []interface{}{
+			map[string]interface{}{"internal_sku": "a1"},
+			map[string]interface{}{"name": "book", "internal_sku": "b1"},
+		},
+		"internal_note": "secret",
+		captchaField:    "AB12C",
+		"website":       "",
+	}
+
+	tests := []struct {
+		allow, deny []string
+		want        interface{}
+	}{
+		{nil, nil, map[string]interface{}{
+			"name":    "Ken",
+			"email":   "ken@thompson.email",
+			"address": map[string]interface{}{"city": "Berkeley", "zip": "94720"},
+			"tags":    []interface{}{"unix", "go"},
+			"items": []interface{}{
+				map[string]interface{}{"internal_sku": "a1"},
+				map[string]interface{}{"name": "book", "internal_sku": "b1"},
+			},
+			"internal_note": "secret",
+		}},
+		{nil, []string{"internal_*", "address.zip", "items.*.internal_*"}, map[string]interface{}{
+			"name":    "Ken",
+			"email":   "ken@thompson.email",
+			"address": map[string]interface{}{"city": "Berkeley"},
+			"tags":    []interface{}{"unix", "go"},
+			// the first item keeps its position, like items.1.name in .Form
+			"items": []interface{}{map[string]interface{}{}, map[string]interface{}{"name": "book"}},
+		}},
+		{[]string{"name", "address.*"}, []string{"address.zip"}, map[string]interface{}{
+			"name":    "Ken",
+			"address": map[string]interface{}{"city": "Berkeley"},
+		}},
+		{[]string{"nothing"}, nil, map[string]interface{}{}},
+	}
+	for i, test := range tests {
+		mc := newConfig()
+		mc.Captcha = true
+		mc.honeypotField = "website"
+		mc.fieldsAllow = test.allow
+		mc.fieldsDeny = test.deny
+		assert.Exactly(t, test.want, mc.templateJSON(data), "Index %d", i)
+	}
+	assert.Nil(t, newConfig().templateJSON(nil))
+}
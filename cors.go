@@ -0,0 +1,109 @@
+package mailout
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, POST, OPTIONS"
+	corsAllowHeaders = "Content-Type, X-CSRF-Token, X-Requested-With, Idempotency-Key"
+	corsMaxAge       = "600"
+)
+
+// isRoute returns true if the path gets served by mailout.
+func (h *handler) isRoute(path string) bool {
+	switch path {
+	case h.config.endpoint:
+		return true
+	case h.config.endpoint + "/captcha":
+		return h.config.Captcha
+	case h.config.endpoint + "/captcha.json":
+		return h.config.Captcha && h.config.captchaJSON
+	case h.config.endpoint + "/token":
+		return h.config.timeTrap
+	case h.config.endpoint + "/csrf":
+		return h.config.csrf
+	case h.config.endpoint + "/pow":
+		return h.config.pow
+	case h.config.endpoint + "/bayes":
+		return h.config.bayesAdminToken != ""
+	}
+	return false
+}
+
+// isAllowedOrigin checks if the origin matches one of the configured origins.
+// The origin "*" allows all origins.
+func (c *config) isAllowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	origin = normalizeOrigin(origin)
+	for _, o := range c.allowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the Origin header or, if empty, the origin extracted
+// from the Referer header.
+func requestOrigin(r *http.Request) string {
+	if o := r.Header.Get("Origin"); o != "" && o != "null" {
+		return o
+	}
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Scheme == "" || ref.Host == "" {
+		return ""
+	}
+	return ref.Scheme + "://" + ref.Host
+}
+
+// normalizeOrigin lower cases the origin and removes a trailing slash.
+func normalizeOrigin(o string) string {
+	return strings.TrimRight(strings.ToLower(strings.TrimSpace(o)), "/")
+}
+
+// isListedOrigin returns true if the origin has been configured explicitly and
+// not only allowed by "*".
+func (c *config) isListedOrigin(origin string) bool {
+	origin = normalizeOrigin(origin)
+	for _, o := range c.allowedOrigins {
+		if o != "*" && o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// setCORSHeaders writes the Access-Control headers for an allowed origin.
+// Only listed origins may send credentials, all others allowed by "*" get a
+// literal "*", so no foreign site can read responses with the users cookies.
+// Both responses vary by the origin, so caches must not mix them up.
+func setCORSHeaders(h http.Header, origin string, listed, preflight bool) {
+	if listed {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	h.Add("Vary", "Origin")
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		h.Set("Access-Control-Max-Age", corsMaxAge)
+	}
+}
+
+// splitOrigins splits a comma separated list of origins.
+func splitOrigins(s string) []string {
+	var ret []string
+	for _, o := range strings.Split(s, ",") {
+		if o = normalizeOrigin(o); o != "" {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
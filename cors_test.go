@@ -0,0 +1,90 @@
+package mailout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_CORS(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		allowed_origins "https://www.example.com, https://shop.example.com/"
+	}`)
+	assert.Exactly(t, []string{"https://www.example.com", "https://shop.example.com"}, h.config.allowedOrigins)
+
+	tests := []struct {
+		method     string
+		path       string
+		origin     string
+		referer    string
+		wantCode   int
+		wantOrigin string
+	}{
+		{"OPTIONS", "/mailout", "https://www.example.com", "", http.StatusNoContent, "https://www.example.com"},
+		{"OPTIONS", "/mailout", "https://evil.example", "", http.StatusForbidden, ""},
+		{"POST", "/mailout", "https://shop.example.com", "", http.StatusOK, "https://shop.example.com"},
+		{"POST", "/mailout", "HTTPS://Shop.Example.com", "", http.StatusOK, "HTTPS://Shop.Example.com"},
+		{"POST", "/mailout", "https://evil.example", "", http.StatusForbidden, ""},
+		{"POST", "/mailout", "", "https://www.example.com/contact.html", http.StatusOK, "https://www.example.com"},
+		{"POST", "/mailout", "", "https://evil.example/contact.html", http.StatusForbidden, ""},
+		{"POST", "/mailout", "", "", http.StatusForbidden, ""},
+		{"GET", "/mailout", "", "", http.StatusMethodNotAllowed, ""},
+		{"OPTIONS", "/other", "https://www.example.com", "", http.StatusTeapot, ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.PostForm = url.Values{"email": []string{"ken@thompson.email"}}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			req.Header.Set("Referer", test.referer)
+		}
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, req)
+		if err != nil {
+			t.Fatal("Index", i, "Error:", err)
+		}
+		if code == StatusEmpty {
+			code = w.Code
+		}
+		assert.Exactly(t, test.wantCode, code, "Index %d", i)
+		assert.Exactly(t, test.wantOrigin, w.Header().Get("Access-Control-Allow-Origin"), "Index %d", i)
+		if test.method == "OPTIONS" && test.wantOrigin != "" {
+			assert.Exactly(t, corsAllowMethods, w.Header().Get("Access-Control-Allow-Methods"), "Index %d", i)
+			assert.Exactly(t, corsAllowHeaders, w.Header().Get("Access-Control-Allow-Headers"), "Index %d", i)
+		}
+	}
+}
+
+func TestServeHTTP_CORSWildcard(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		allowed_origins "https://www.example.com, *"
+	}`)
+
+	tests := []struct {
+		origin          string
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{"https://www.example.com", "https://www.example.com", "true"},
+		{"https://evil.example", "*", ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("OPTIONS", "/mailout", nil)
+		req.Header.Set("Origin", test.origin)
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal("Index", i, "Error:", err)
+		}
+		assert.Exactly(t, http.StatusNoContent, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantOrigin, w.Header().Get("Access-Control-Allow-Origin"), "Index %d", i)
+		assert.Exactly(t, test.wantCredentials, w.Header().Get("Access-Control-Allow-Credentials"), "Index %d", i)
+		assert.Exactly(t, "Origin", w.Header().Get("Vary"), "Index %d", i)
+	}
+}
@@ -0,0 +1,81 @@
+package mailout
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfCookieName name of the cookie containing the CSRF token.
+	csrfCookieName = "mailout_csrf"
+	// csrfField form field name which must contain the CSRF token.
+	csrfField = "csrf_token"
+	// csrfHeader alternative to the form field for AJAX requests.
+	csrfHeader = "X-CSRF-Token"
+)
+
+var errCSRFInvalid = errors.New("Invalid CSRF token")
+
+// csrfProtector implements the double submit cookie pattern with signed
+// tokens. The route {endpoint}/csrf sets the token as a cookie and returns it
+// in the response body. A submission must contain the same token in the form
+// field or the header.
+type csrfProtector struct {
+	key []byte
+	// crossSite sends the cookie also with cross site requests. Requires
+	// HTTPS.
+	crossSite bool
+}
+
+// newCSRFProtector creates a new protector. An empty secret generates a
+// random key which is only valid for the lifetime of the process.
+func newCSRFProtector(secret string, crossSite bool) csrfProtector {
+	key := []byte(secret)
+	if secret == "" {
+		key = randomKey(32)
+	}
+	return csrfProtector{key: key, crossSite: crossSite}
+}
+
+// issue creates a new token and sets it as a cookie.
+func (cp csrfProtector) issue(w http.ResponseWriter, path string) string {
+	nonce := base64.RawURLEncoding.EncodeToString(randomKey(18))
+	token := nonce + "." + hmacSign(cp.key, nonce)
+	c := &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if cp.crossSite {
+		c.SameSite = http.SameSiteNoneMode
+		c.Secure = true
+	}
+	http.SetCookie(w, c)
+	return token
+}
+
+// verify compares the token of the cookie with the submitted one and checks
+// the signature.
+func (cp csrfProtector) verify(r *http.Request) error {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return errCSRFInvalid
+	}
+	submitted := r.Header.Get(csrfHeader)
+	if submitted == "" {
+		submitted = r.PostFormValue(csrfField)
+	}
+	if !hmac.Equal([]byte(c.Value), []byte(submitted)) {
+		return errCSRFInvalid
+	}
+	pos := strings.IndexByte(submitted, '.')
+	if pos < 1 || !hmac.Equal([]byte(submitted[pos+1:]), []byte(hmacSign(cp.key, submitted[:pos]))) {
+		return errCSRFInvalid
+	}
+	return nil
+}
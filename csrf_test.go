@@ -0,0 +1,98 @@
+package mailout
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFProtector(t *testing.T) {
+
+	cp := newCSRFProtector("s3cr3t", false)
+	w := httptest.NewRecorder()
+	token := cp.issue(w, "/mailout")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	assert.Exactly(t, csrfCookieName, cookies[0].Name)
+	assert.Exactly(t, token, cookies[0].Value)
+	assert.True(t, cookies[0].HttpOnly)
+
+	forged := "abc." + hmacSign([]byte("wrong"), "abc")
+
+	tests := []struct {
+		cookie string
+		field  string
+		header string
+		want   error
+	}{
+		{"", "", "", errCSRFInvalid},
+		{token, "", "", errCSRFInvalid},
+		{"", token, "", errCSRFInvalid},
+		{token, token + "x", "", errCSRFInvalid},
+		{forged, forged, "", errCSRFInvalid},
+		{token, token, "", nil},
+		{token, "", token, nil},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{csrfField: []string{test.field}}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: test.cookie})
+		}
+		if test.header != "" {
+			req.Header.Set(csrfHeader, test.header)
+		}
+		assert.Exactly(t, test.want, cp.verify(req), "Index %d", i)
+	}
+}
+
+func TestServeHTTP_CSRF(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		csrf
+	}`)
+
+	w := httptest.NewRecorder()
+	code, err := h.ServeHTTP(w, httptest.NewRequest("GET", "/mailout/csrf", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, StatusEmpty, code)
+	assert.Exactly(t, http.StatusOK, w.Code)
+	var jt JSONToken
+	if err := json.NewDecoder(w.Body).Decode(&jt); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+
+	data := make(url.Values)
+	data.Set("email", "ken@thompson.email")
+
+	// cross site post without cookie and token
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = data
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusForbidden, w.Code)
+	assert.Exactly(t, "{\"code\":403,\"error\":\"Invalid CSRF token\"}\n", w.Body.String())
+
+	data.Set(csrfField, jt.Token)
+	req = httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = data
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+}
@@ -42,6 +42,8 @@ func goMailDaemon(mc *config, rChan <-chan *http.Request) {
 		d.TLSConfig.InsecureSkipVerify = true
 	}
 
+	arl := newAutoreplyLimiter(mc.autoreplyInterval, mc.autoreplyMax)
+
 	var s gomail.SendCloser
 	var err error
 	open := false
@@ -52,7 +54,17 @@ func goMailDaemon(mc *config, rChan <-chan *http.Request) {
 				return
 			}
 
-			mails := newMessage(mc, r).build()
+			bm := newMessage(mc, r)
+			mails := bm.build()
+			if !spamdCheck(mc, bm, mails) {
+				continue
+			}
+			// the submitter gets no confirmation for suspected spam
+			if !isSpamTagged(mails) {
+				if ar := bm.autoreply(arl); ar != nil {
+					mails = append(mails, ar)
+				}
+			}
 			// multiple mails will increase the rate limit at some MTAs.
 			// so the REST API rate limit must be: rate / pgpEmailAddresses
 
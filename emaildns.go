@@ -0,0 +1,122 @@
+package mailout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailDNSCacheMax number of cached domains after which expired entries get
+// removed. If none has expired, the oldest entry gets removed.
+const emailDNSCacheMax = 10000
+
+// dnsResolver looks up the records of a domain. *net.Resolver implements it.
+type dnsResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// emailDNSChecker verifies that the domain of an email address has MX, A or
+// AAAA records and caches the results.
+type emailDNSChecker struct {
+	resolver dnsResolver
+	timeout  time.Duration
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]emailDNSEntry
+}
+
+type emailDNSEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+func newEmailDNSChecker(r dnsResolver, timeout, ttl time.Duration) *emailDNSChecker {
+	return &emailDNSChecker{
+		resolver: r,
+		timeout:  timeout,
+		ttl:      ttl,
+		now:      time.Now,
+		cache:    make(map[string]emailDNSEntry),
+	}
+}
+
+// check returns an error if the domain of the address does not exist or has
+// no records. Timeouts and other temporary DNS errors get returned with
+// temporary set to true and are not cached, the address should then be
+// accepted.
+func (dc *emailDNSChecker) check(email string) (temporary bool, err error) {
+	domain := normalizeDomain(email[strings.LastIndexByte(email, '@')+1:])
+	now := dc.now()
+
+	dc.mu.Lock()
+	e, ok := dc.cache[domain]
+	dc.mu.Unlock()
+	if !ok || now.After(e.expires) {
+		if e.ok, err = dc.lookup(domain); err != nil {
+			return true, err
+		}
+		dc.store(domain, emailDNSEntry{ok: e.ok, expires: now.Add(dc.ttl)}, now)
+	}
+	if !e.ok {
+		return false, fmt.Errorf("Email domain %q has no MX, A or AAAA records", domain)
+	}
+	return false, nil
+}
+
+// lookup queries the MX and if there are none the A and AAAA records.
+func (dc *emailDNSChecker) lookup(domain string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dc.timeout)
+	defer cancel()
+
+	mxs, err := dc.resolver.LookupMX(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return false, err
+	}
+	for _, mx := range mxs {
+		if mx.Host != "." && mx.Host != "" { // RFC 7505 null MX accepts no mail
+			return true, nil
+		}
+	}
+	if len(mxs) > 0 {
+		return false, nil
+	}
+
+	ips, err := dc.resolver.LookupIPAddr(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return false, err
+	}
+	return len(ips) > 0, nil
+}
+
+func (dc *emailDNSChecker) store(domain string, e emailDNSEntry, now time.Time) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if _, ok := dc.cache[domain]; !ok && len(dc.cache) >= emailDNSCacheMax {
+		var oldest string
+		for d, old := range dc.cache {
+			if now.After(old.expires) {
+				delete(dc.cache, d)
+			} else if oldest == "" || old.expires.Before(dc.cache[oldest].expires) {
+				oldest = d
+			}
+		}
+		// all entries have the same ttl, so the first to expire is the oldest
+		if len(dc.cache) >= emailDNSCacheMax {
+			delete(dc.cache, oldest)
+		}
+	}
+	dc.cache[domain] = e
+}
+
+// isDNSNotFound returns true if the domain or its records do not exist.
+func isDNSNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
@@ -0,0 +1,164 @@
+package mailout
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubResolver answers from maps. Unknown domains do not exist. Domains in
+// slow block until the context gets canceled.
+type stubResolver struct {
+	mx      map[string][]*net.MX
+	ips     map[string][]net.IPAddr
+	slow    map[string]bool
+	lookups int32
+}
+
+func (sr *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	atomic.AddInt32(&sr.lookups, 1)
+	if sr.slow[name] {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: true}
+	}
+	if mx, ok := sr.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (sr *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := sr.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newStubResolver() *stubResolver {
+	return &stubResolver{
+		mx: map[string][]*net.MX{
+			"thompson.email": {{Host: "mx.thompson.email.", Pref: 10}},
+			"nullmx.tld":     {{Host: ".", Pref: 0}},
+		},
+		ips: map[string][]net.IPAddr{
+			"aonly.tld":  {{IP: net.ParseIP("192.0.2.1")}},
+			"nullmx.tld": {{IP: net.ParseIP("192.0.2.2")}},
+		},
+		slow: map[string]bool{
+			"slow.tld": true,
+		},
+	}
+}
+
+func TestEmailDNSChecker_Check(t *testing.T) {
+
+	dc := newEmailDNSChecker(newStubResolver(), 50*time.Millisecond, time.Hour)
+
+	tests := []struct {
+		email         string
+		wantTemporary bool
+		wantErr       string
+	}{
+		{"ken@thompson.email", false, ""},
+		{"ken@Thompson.Email", false, ""},
+		{"ken@aonly.tld", false, ""},
+		{"ken@gmial.con", false, `Email domain "gmial.con" has no MX, A or AAAA records`},
+		{"ken@nullmx.tld", false, `Email domain "nullmx.tld" has no MX, A or AAAA records`},
+		{"ken@slow.tld", true, "lookup slow.tld: context deadline exceeded"},
+	}
+	for i, test := range tests {
+		temporary, err := dc.check(test.email)
+		assert.Exactly(t, test.wantTemporary, temporary, "Index %d", i)
+		if test.wantErr == "" {
+			assert.NoError(t, err, "Index %d", i)
+			continue
+		}
+		assert.EqualError(t, err, test.wantErr, "Index %d", i)
+	}
+}
+
+func TestEmailDNSChecker_Cache(t *testing.T) {
+
+	sr := newStubResolver()
+	dc := newEmailDNSChecker(sr, time.Second, time.Minute)
+	now := time.Now()
+	dc.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, err := dc.check("ken@thompson.email")
+		assert.NoError(t, err)
+		_, err = dc.check("ken@gmial.con")
+		assert.Error(t, err)
+	}
+	assert.Exactly(t, int32(2), atomic.LoadInt32(&sr.lookups))
+
+	// timeouts do not get cached
+	dc.timeout = time.Millisecond
+	dc.check("ken@slow.tld")
+	dc.check("ken@slow.tld")
+	assert.Exactly(t, int32(4), atomic.LoadInt32(&sr.lookups))
+
+	now = now.Add(time.Minute + time.Second)
+	dc.timeout = time.Second
+	_, err := dc.check("ken@thompson.email")
+	assert.NoError(t, err)
+	assert.Exactly(t, int32(5), atomic.LoadInt32(&sr.lookups))
+}
+
+func TestEmailDNSChecker_CacheFull(t *testing.T) {
+
+	dc := newEmailDNSChecker(newStubResolver(), time.Second, time.Minute)
+	now := time.Now()
+	for i := 0; i < emailDNSCacheMax; i++ {
+		dc.store("d"+strconv.Itoa(i)+".tld", emailDNSEntry{ok: true, expires: now.Add(time.Minute + time.Duration(i))}, now)
+	}
+	assert.Len(t, dc.cache, emailDNSCacheMax)
+
+	// nothing expired, the oldest entry gets evicted
+	dc.store("new.tld", emailDNSEntry{ok: true, expires: now.Add(time.Hour)}, now)
+	assert.Len(t, dc.cache, emailDNSCacheMax)
+	assert.NotContains(t, dc.cache, "d0.tld")
+	assert.Contains(t, dc.cache, "d1.tld")
+	assert.Contains(t, dc.cache, "new.tld")
+
+	// expired entries get removed
+	later := now.Add(time.Minute * 2)
+	dc.store("later.tld", emailDNSEntry{ok: true, expires: later.Add(time.Minute)}, later)
+	assert.Len(t, dc.cache, 2)
+}
+
+func TestServeHTTP_EmailDNSCheck(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		email_dns_check
+		email_dns_timeout 50ms
+	}`)
+	assert.NotNil(t, h.emailDNS)
+	h.emailDNS.resolver = newStubResolver()
+
+	tests := []struct {
+		email    string
+		wantCode int
+	}{
+		{"ken@gmial.con", StatusUnprocessableEntity},
+		{"ken@thompson.email", 200},
+		// a timeout accepts the address
+		{"ken@slow.tld", 200},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{"email": {test.email}}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+	}
+}
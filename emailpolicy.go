@@ -0,0 +1,107 @@
+package mailout
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// emailPolicy restricts the domains and addresses of the email field.
+type emailPolicy struct {
+	// allow if not empty only these domains are allowed.
+	allow      map[string]bool
+	blockAddrs map[string]bool
+	block      map[string]bool
+	disposable map[string]bool
+}
+
+// newEmailPolicy creates the policy. Entries of the block list containing an
+// @ are addresses, otherwise domains. The disposable file contains one domain
+// per line, comments start with #. Returns nil if nothing has been configured.
+func newEmailPolicy(allow, block []string, disposableFile string) (*emailPolicy, error) {
+	if len(allow) == 0 && len(block) == 0 && disposableFile == "" {
+		return nil, nil
+	}
+	ep := &emailPolicy{
+		allow:      make(map[string]bool),
+		blockAddrs: make(map[string]bool),
+		block:      make(map[string]bool),
+		disposable: make(map[string]bool),
+	}
+	for _, d := range allow {
+		ep.allow[normalizeDomain(d)] = true
+	}
+	for _, b := range block {
+		if strings.Contains(b, "@") {
+			ep.blockAddrs[strings.ToLower(strings.TrimSpace(b))] = true
+			continue
+		}
+		ep.block[normalizeDomain(b)] = true
+	}
+	if disposableFile == "" {
+		return ep, nil
+	}
+
+	f, err := os.Open(disposableFile)
+	if err != nil {
+		return nil, fmt.Errorf("[mailout] Cannot open disposable email domains %q: %s", disposableFile, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if d := normalizeDomain(line); d != "" {
+			ep.disposable[d] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("[mailout] Cannot read disposable email domains %q: %s", disposableFile, err)
+	}
+	return ep, nil
+}
+
+// check returns an error with the reason if the address violates the policy.
+// The address must already be syntactically valid.
+func (ep *emailPolicy) check(email string) error {
+	if ep == nil {
+		return nil
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	domain := normalizeDomain(email[strings.LastIndexByte(email, '@')+1:])
+
+	switch {
+	case len(ep.allow) > 0 && !matchDomain(ep.allow, domain):
+		return codedError{errCodeEmailNotAllowed, fmt.Sprintf("Email domain not allowed: %q", domain)}
+	case ep.blockAddrs[email]:
+		return codedError{errCodeEmailBlocked, fmt.Sprintf("Email address blocked: %q", email)}
+	case matchDomain(ep.block, domain):
+		return codedError{errCodeEmailDomainBlocked, fmt.Sprintf("Email domain blocked: %q", domain)}
+	case matchDomain(ep.disposable, domain):
+		return codedError{errCodeEmailDisposable, fmt.Sprintf("Disposable email address not allowed: %q", domain)}
+	}
+	return nil
+}
+
+// matchDomain returns true if the domain or one of its parent domains is in
+// the set.
+func matchDomain(set map[string]bool, domain string) bool {
+	for domain != "" {
+		if set[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
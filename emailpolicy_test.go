@@ -0,0 +1,84 @@
+package mailout
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailPolicy_Check(t *testing.T) {
+
+	tests := []struct {
+		allow      []string
+		block      []string
+		disposable string
+		email      string
+		wantErr    string
+	}{
+		{nil, nil, "", "ken@thompson.email", ""},
+		{nil, nil, "testdata/disposable_domains.txt", "ken@mailinator.com", `Disposable email address not allowed: "mailinator.com"`},
+		{nil, nil, "testdata/disposable_domains.txt", "ken@spam4.GuerrillaMail.com", `Disposable email address not allowed: "spam4.guerrillamail.com"`},
+		{nil, nil, "testdata/disposable_domains.txt", "ken@notmailinator.com", ""},
+		{nil, []string{"spam.tld"}, "", "ken@spam.tld", `Email domain blocked: "spam.tld"`},
+		{nil, []string{"spam.tld"}, "", "ken@mx.spam.tld", `Email domain blocked: "mx.spam.tld"`},
+		{nil, []string{"Bad@Thompson.email"}, "", "bad@thompson.email", `Email address blocked: "bad@thompson.email"`},
+		{nil, []string{"bad@thompson.email"}, "", "ken@thompson.email", ""},
+		{[]string{"company.tld"}, nil, "", "ken@thompson.email", `Email domain not allowed: "thompson.email"`},
+		{[]string{"company.tld"}, nil, "", "ken@sales.company.tld", ""},
+		{[]string{"company.tld"}, []string{"intern@company.tld"}, "", "intern@company.tld", `Email address blocked: "intern@company.tld"`},
+	}
+	for i, test := range tests {
+		ep, err := newEmailPolicy(test.allow, test.block, test.disposable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ep.check(test.email)
+		if test.wantErr == "" {
+			assert.NoError(t, err, "Index %d", i)
+			continue
+		}
+		assert.EqualError(t, err, test.wantErr, "Index %d", i)
+	}
+
+	ep, err := newEmailPolicy(nil, nil, "testdata/not_found.txt")
+	assert.Nil(t, ep)
+	assert.Error(t, err)
+
+	ep, err = newEmailPolicy(nil, nil, "")
+	assert.Nil(t, ep)
+	assert.NoError(t, err)
+	assert.NoError(t, ep.check("ken@mailinator.com"))
+}
+
+func TestServeHTTP_EmailPolicy(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		email_disposable testdata/disposable_domains.txt
+		email_block      spam.tld
+	}`)
+	if err := h.config.loadEmailPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email    string
+		wantCode int
+		wantBody string
+	}{
+		{"ken@mailinator.com", StatusUnprocessableEntity, `{"code":422,"error":"Disposable email address not allowed: \"mailinator.com\""}`},
+		{"ken@spam.tld", StatusUnprocessableEntity, `{"code":422,"error":"Email domain blocked: \"spam.tld\""}`},
+		{"ken@thompson.email", 200, `{"code":200}`},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{"email": {test.email}}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+	}
+}
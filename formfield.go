@@ -0,0 +1,242 @@
+package mailout
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy"
+)
+
+// Types of a form field.
+const (
+	fieldText   = "text"
+	fieldEmail  = "email"
+	fieldPhone  = "phone"
+	fieldURL    = "url"
+	fieldNumber = "number"
+	fieldDate   = "date"
+	fieldSelect = "select"
+)
+
+const fieldDateLayout = "2006-01-02"
+
+// msgInvalidEmail field message of an invalid email address.
+const msgInvalidEmail = "is not a valid email address"
+
+var phoneRegex = regexp.MustCompile(`^\+?[0-9 ()./-]+$`)
+
+// formField declares the schema of a form field.
+type formField struct {
+	name     string
+	required bool
+	// typ one of the field constants. Default text.
+	typ string
+	// options allowed values of a select field.
+	options []string
+	// minLength and maxLength in characters. 0 disables the check.
+	minLength int
+	maxLength int
+	// min and max value of a number field. Nil disables the check.
+	min *float64
+	max *float64
+	re  *regexp.Regexp
+	// def gets set if the field is empty.
+	def string
+}
+
+// parseFormField parses the block of the field sub-directive:
+//
+//	field name {
+//		required
+//		type select
+//		options a b c
+//	}
+func parseFormField(c *caddy.Controller) (*formField, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	f := &formField{
+		name: c.Val(),
+		typ:  fieldText,
+	}
+	if !c.NextArg() {
+		return f, nil // no block
+	}
+	if c.Val() != "{" {
+		return nil, c.SyntaxErr("{")
+	}
+
+	var err error
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return f, f.validate()
+		case "required":
+			f.required = true
+		case "type":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			f.typ = c.Val()
+		case "options":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			f.options = append(f.options, splitList(args)...)
+		case "min_length", "max_length":
+			dir := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			var l int
+			if l, err = strconv.Atoi(c.Val()); err != nil {
+				return nil, err
+			}
+			if dir == "min_length" {
+				f.minLength = l
+			} else {
+				f.maxLength = l
+			}
+		case "min", "max":
+			dir := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			var v float64
+			if v, err = strconv.ParseFloat(c.Val(), 64); err != nil {
+				return nil, err
+			}
+			if dir == "min" {
+				f.min = &v
+			} else {
+				f.max = &v
+			}
+		case "regex":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			if f.re, err = regexp.Compile(c.Val()); err != nil {
+				return nil, err
+			}
+		case "default":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			f.def = c.Val()
+		default:
+			return nil, c.Errf("Unknown field property '%s'", c.Val())
+		}
+	}
+	return nil, c.EOFErr()
+}
+
+func (f *formField) validate() error {
+	switch f.typ {
+	case fieldText, fieldEmail, fieldPhone, fieldURL, fieldNumber, fieldDate:
+	case fieldSelect:
+		if len(f.options) == 0 {
+			return fmt.Errorf("[mailout] Field %q of type select requires options", f.name)
+		}
+	default:
+		return fmt.Errorf("[mailout] Field %q has an unknown type %q", f.name, f.typ)
+	}
+	return nil
+}
+
+// validateFields sets the defaults and validates the form. Returns the error
+// messages of every failing field.
+func validateFields(fields []*formField, form url.Values) map[string][]string {
+	var errs map[string][]string
+	for _, f := range fields {
+		if f.def != "" && strings.TrimSpace(form.Get(f.name)) == "" {
+			form.Set(f.name, f.def)
+		}
+		if msgs := f.check(form[f.name]); len(msgs) > 0 {
+			if errs == nil {
+				errs = make(map[string][]string)
+			}
+			errs[f.name] = msgs
+		}
+	}
+	return errs
+}
+
+// check returns the error messages of the first invalid value.
+func (f *formField) check(values []string) []string {
+	empty := true
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		empty = false
+		if msgs := f.checkValue(v); len(msgs) > 0 {
+			return msgs
+		}
+	}
+	if empty && f.required {
+		return []string{"is required"}
+	}
+	return nil
+}
+
+func (f *formField) checkValue(v string) (msgs []string) {
+	if l := utf8.RuneCountInString(v); f.minLength > 0 && l < f.minLength {
+		msgs = append(msgs, fmt.Sprintf("must be at least %d characters", f.minLength))
+	} else if f.maxLength > 0 && l > f.maxLength {
+		msgs = append(msgs, fmt.Sprintf("must be at most %d characters", f.maxLength))
+	}
+
+	switch f.typ {
+	case fieldEmail:
+		if !isValidEmail(v) {
+			msgs = append(msgs, msgInvalidEmail)
+		}
+	case fieldPhone:
+		if !phoneRegex.MatchString(v) || countDigits(v) < 5 {
+			msgs = append(msgs, "is not a valid phone number")
+		}
+	case fieldURL:
+		u, err := url.ParseRequestURI(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, "is not a valid URL")
+		}
+	case fieldNumber:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		switch {
+		case err != nil:
+			msgs = append(msgs, "is not a number")
+		case f.min != nil && n < *f.min:
+			msgs = append(msgs, fmt.Sprintf("must be at least %g", *f.min))
+		case f.max != nil && n > *f.max:
+			msgs = append(msgs, fmt.Sprintf("must be at most %g", *f.max))
+		}
+	case fieldDate:
+		if _, err := time.Parse(fieldDateLayout, v); err != nil {
+			msgs = append(msgs, "is not a valid date (YYYY-MM-DD)")
+		}
+	case fieldSelect:
+		if !containsString(f.options, v) {
+			msgs = append(msgs, "is not a valid option")
+		}
+	}
+
+	if f.re != nil && !f.re.MatchString(v) {
+		msgs = append(msgs, "has an invalid format")
+	}
+	return msgs
+}
+
+func countDigits(s string) (n int) {
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,254 @@
+package mailout
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormField_Errors(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr error
+	}{
+		{
+			`mailout {
+				field
+			}`,
+			errors.New("Testfile:2 - Error during parsing: Wrong argument count or unexpected line ending after 'field'"),
+		},
+		{
+			`mailout {
+				field name required
+			}`,
+			errors.New("Testfile:2 - Syntax error: Unexpected token 'required', expecting '{'"),
+		},
+		{
+			`mailout {
+				field name {
+					colour red
+				}
+			}`,
+			errors.New("Testfile:3 - Error during parsing: Unknown field property 'colour'"),
+		},
+		{
+			`mailout {
+				field name {
+					type color
+				}
+			}`,
+			errors.New(`[mailout] Field "name" has an unknown type "color"`),
+		},
+		{
+			`mailout {
+				field topic {
+					type select
+				}
+			}`,
+			errors.New(`[mailout] Field "topic" of type select requires options`),
+		},
+		{
+			`mailout {
+				field name {
+					max_length many
+				}
+			}`,
+			errors.New(`strconv.Atoi: parsing "many": invalid syntax`),
+		},
+		{
+			`mailout {
+				field name {
+					regex "[a-z"
+				}
+			}`,
+			errors.New("error parsing regexp: missing closing ]: `[a-z`"),
+		},
+	}
+	for i, test := range tests {
+		_, err := parse(caddy.NewTestController("http", test.config))
+		assert.EqualError(t, err, test.wantErr.Error(), "Index %d", i)
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+
+	mc, err := parse(caddy.NewTestController("http", `mailout {
+		field name {
+			required
+			min_length 2
+			max_length 10
+		}
+		field phone {
+			type phone
+		}
+		field website {
+			type url
+		}
+		field guests {
+			type number
+			min  1
+			max  8
+			default 2
+		}
+		field arrival {
+			type date
+		}
+		field topic {
+			type    select
+			options sales support "press office"
+		}
+		field zip {
+			max_length 5
+			regex      "^[0-9]{5}$"
+		}
+		field cc_email {
+			type email
+		}
+		field newsletter
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, mc.fields, 9)
+
+	tests := []struct {
+		form       url.Values
+		wantErrs   map[string][]string
+		wantGuests string
+	}{
+		{
+			url.Values{"name": {"Ken"}},
+			nil,
+			"2",
+		},
+		{
+			url.Values{
+				"name":     {"Ken Thompson"},
+				"phone":    {"+49 (0)30 123-456"},
+				"website":  {"https://thompson.email/about"},
+				"guests":   {"8"},
+				"arrival":  {"2016-01-31"},
+				"topic":    {"press office"},
+				"zip":      {"12345"},
+				"cc_email": {"ken@thompson.email"},
+			},
+			map[string][]string{
+				"name": {"must be at most 10 characters"},
+			},
+			"8",
+		},
+		{
+			url.Values{
+				"name":     {" "},
+				"phone":    {"call me"},
+				"website":  {"javascript:alert(1)"},
+				"guests":   {"9"},
+				"arrival":  {"31.01.2016"},
+				"topic":    {"sales", "marketing"},
+				"zip":      {"1234"},
+				"cc_email": {"ken"},
+			},
+			map[string][]string{
+				"name":     {"is required"},
+				"phone":    {"is not a valid phone number"},
+				"website":  {"is not a valid URL"},
+				"guests":   {"must be at most 8"},
+				"arrival":  {"is not a valid date (YYYY-MM-DD)"},
+				"topic":    {"is not a valid option"},
+				"zip":      {"has an invalid format"},
+				"cc_email": {"is not a valid email address"},
+			},
+			"9",
+		},
+		{
+			url.Values{"name": {"K"}, "guests": {"many"}, "phone": {"123"}, "zip": {"123456"}},
+			map[string][]string{
+				"name":   {"must be at least 2 characters"},
+				"zip":    {"must be at most 5 characters", "has an invalid format"},
+				"guests": {"is not a number"},
+				"phone":  {"is not a valid phone number"},
+			},
+			"many",
+		},
+	}
+	for i, test := range tests {
+		errs := validateFields(mc.fields, test.form)
+		assert.Exactly(t, test.wantErrs, errs, "Index %d", i)
+		assert.Exactly(t, test.wantGuests, test.form.Get("guests"), "Index %d", i)
+	}
+}
+
+func TestServeHTTP_FormFields(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		field name {
+			required
+		}
+		field topic {
+			type    select
+			options sales support
+		}
+	}`)
+
+	newReq := func(accept string) *http.Request {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.Header.Set("Accept", accept)
+		req.PostForm = url.Values{
+			"email": {"ken@thompson.email"},
+			"topic": {"marketing"},
+		}
+		return req
+	}
+
+	// version 1 keeps the old shape
+	w := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, newReq("application/json")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, StatusUnprocessableEntity, w.Code)
+	assert.Exactly(t, `{"code":422,"error":"Invalid form fields"}`+"\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, newReq(headerApplicationJSONV2)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, StatusUnprocessableEntity, w.Code)
+
+	var je JSONErrorV2
+	if err := json.NewDecoder(w.Body).Decode(&je); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, JSONErrorV2{
+		Version:   2,
+		Code:      StatusUnprocessableEntity,
+		Error:     "Invalid form fields",
+		ErrorCode: errCodeInvalidFields,
+		Fields: map[string][]string{
+			"name":  {"is required"},
+			"topic": {"is not a valid option"},
+		},
+	}, je)
+
+	// an invalid email address gets reported together with the schema errors
+	req := newReq(headerApplicationJSONV2)
+	req.PostForm.Set("email", "kenthompson.email")
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	je = JSONErrorV2{}
+	if err := json.NewDecoder(w.Body).Decode(&je); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, map[string][]string{
+		"email": {msgInvalidEmail},
+		"name":  {"is required"},
+		"topic": {"is not a valid option"},
+	}, je.Fields)
+}
@@ -0,0 +1,242 @@
+package mailout
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	idempotencyKeyMaxLength  = 255
+	idempotencySweepInterval = time.Minute
+)
+
+var errIdempotencyKeyReused = codedError{errCodeIdempotencyKeyReused, "Idempotency-Key already used for a different submission"}
+
+// idempotencyStore remembers the responses of accepted submissions, so a
+// repeated submission gets the same response without sending the email
+// again.
+type idempotencyStore struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	nextSweep time.Time
+}
+
+// idempotencyEntry is pending until done gets closed. Afterwards resp
+// contains the response or the entry has been removed because the submission
+// failed.
+type idempotencyEntry struct {
+	fingerprint string
+	done        chan struct{}
+	completed   bool
+	expires     time.Time
+	resp        *recordedResponse
+}
+
+// recordedResponse the parts of a response which get replayed.
+type recordedResponse struct {
+	code        int
+	contentType string
+	location    string
+	body        []byte
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:  window,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// reserve returns the entry of an earlier submission with the same key, or
+// creates a new pending entry and returns reserved true. The caller of a
+// reserved entry must call finish.
+func (s *idempotencyStore) reserve(key, fingerprint string) (e *idempotencyEntry, reserved bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.After(s.nextSweep) {
+		for k, e := range s.entries {
+			if e.completed && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.nextSweep = now.Add(idempotencySweepInterval)
+	}
+
+	if e, ok := s.entries[key]; ok && (!e.completed || now.Before(e.expires)) {
+		if e.fingerprint != fingerprint {
+			return nil, false, errIdempotencyKeyReused
+		}
+		return e, false, nil
+	}
+	e = &idempotencyEntry{
+		fingerprint: fingerprint,
+		done:        make(chan struct{}),
+	}
+	s.entries[key] = e
+	return e, true, nil
+}
+
+// finish stores the response of a successful submission. A nil response
+// removes the entry, so the submission can be repeated.
+func (s *idempotencyStore) finish(key string, e *idempotencyEntry, resp *recordedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.completed = true
+	e.resp = resp
+	e.expires = s.now().Add(s.window)
+	if resp == nil && s.entries[key] == e {
+		delete(s.entries, key)
+	}
+	close(e.done)
+}
+
+// idempotencyKey returns the key of the submission, taken from the
+// Idempotency-Key header or, if missing, the fingerprint. The fingerprint is
+// a hash of the form and the uploaded files. Internal fields like captcha
+// tokens change with each attempt and are not part of the hash. The key is
+// scoped by the IP address of the client, so no client can get the recorded
+// response of another client.
+func (c *config) idempotencyKey(r *http.Request) (key, fingerprint string) {
+	internal := c.internalFields()
+	keys := make([]string, 0, len(r.PostForm))
+	for k := range r.PostForm {
+		if !containsString(internal, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, k := range keys {
+		for _, v := range r.PostForm[k] {
+			// the zero bytes separate keys and values unambiguously
+			io.WriteString(hash, k)
+			hash.Write([]byte{0})
+			io.WriteString(hash, v)
+			hash.Write([]byte{0})
+		}
+	}
+	for _, u := range uploadsFrom(r.Context()) {
+		io.WriteString(hash, u.field)
+		hash.Write([]byte{0})
+		io.WriteString(hash, u.name)
+		hash.Write([]byte{0})
+		hash.Write(u.data)
+		hash.Write([]byte{0})
+	}
+	fingerprint = hex.EncodeToString(hash.Sum(nil))
+
+	// IP addresses contain no spaces, so the key is unambiguous
+	ip := remoteIP(r)
+	if k := r.Header.Get(headerIdempotencyKey); k != "" {
+		return "key:" + ip + " " + k, fingerprint
+	}
+	return "hash:" + ip + " " + fingerprint, fingerprint
+}
+
+// serveIdempotent replays the response of an earlier identical submission or
+// serves the submission and records its response. A duplicate which arrives
+// while the first submission is still in progress waits for its response.
+func (h *handler) serveIdempotent(w http.ResponseWriter, r *http.Request) (int, error) {
+	if len(r.Header.Get(headerIdempotencyKey)) > idempotencyKeyMaxLength {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusBadRequest,
+			Error: "Idempotency-Key too long",
+		}, w, r)
+	}
+	key, fingerprint := h.config.idempotencyKey(r)
+
+	for {
+		e, reserved, err := h.idempotency.reserve(key, fingerprint)
+		if err != nil {
+			return h.writeJSON(JSONError{
+				Code:      StatusUnprocessableEntity,
+				Error:     err.Error(),
+				ErrorCode: errorCode(err, errCodeUnprocessable),
+			}, w, r)
+		}
+		if reserved {
+			rec := &responseRecorder{ResponseWriter: w}
+			var resp *recordedResponse
+			// waiting duplicates must be released even if the submission panics
+			defer func() { h.idempotency.finish(key, e, resp) }()
+			code, err := h.serveSubmission(rec, r)
+			resp = rec.response(code, err)
+			return code, err
+		}
+
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return http.StatusServiceUnavailable, r.Context().Err()
+		}
+		if e.resp != nil {
+			return e.resp.replay(w)
+		}
+		// the first submission failed, so try it again
+	}
+}
+
+// replay writes the recorded response.
+func (rr *recordedResponse) replay(w http.ResponseWriter) (int, error) {
+	if rr.contentType != "" {
+		w.Header().Set(headerContentType, rr.contentType)
+	}
+	if rr.location != "" {
+		w.Header().Set("Location", rr.location)
+	}
+	w.Header().Set(headerIdempotentReplayed, "true")
+	w.WriteHeader(rr.code)
+	if _, err := w.Write(rr.body); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return StatusEmpty, nil
+}
+
+// responseRecorder passes the response through and records it.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body []byte
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	rec.body = append(rec.body, p...)
+	return rec.ResponseWriter.Write(p)
+}
+
+// response returns the recorded response of a successful submission or nil.
+func (rec *responseRecorder) response(code int, err error) *recordedResponse {
+	if err != nil || code != StatusEmpty || rec.code < 200 || rec.code >= 400 {
+		return nil
+	}
+	return &recordedResponse{
+		code:        rec.code,
+		contentType: rec.Header().Get(headerContentType),
+		location:    rec.Header().Get("Location"),
+		body:        rec.body,
+	}
+}
@@ -0,0 +1,189 @@
+package mailout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newIdempotencyStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	e, reserved, err := s.reserve("k", "fp1")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	// pending
+	e2, reserved, err := s.reserve("k", "fp1")
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.True(t, e == e2)
+	_, _, err = s.reserve("k", "fp2")
+	assert.Exactly(t, errIdempotencyKeyReused, err)
+
+	resp := &recordedResponse{code: 200}
+	s.finish("k", e, resp)
+	<-e.done
+	e2, reserved, _ = s.reserve("k", "fp1")
+	assert.False(t, reserved)
+	assert.True(t, resp == e2.resp)
+
+	// expired
+	now = now.Add(time.Minute * 2)
+	_, reserved, _ = s.reserve("k", "fp2")
+	assert.True(t, reserved)
+	assert.Len(t, s.entries, 1)
+
+	// failed submissions can be repeated
+	e, reserved, _ = s.reserve("failed", "fp1")
+	assert.True(t, reserved)
+	s.finish("failed", e, nil)
+	_, reserved, _ = s.reserve("failed", "fp2")
+	assert.True(t, reserved)
+}
+
+func TestConfig_IdempotencyKey(t *testing.T) {
+	mc := newConfig()
+	mc.honeypotField = "website"
+
+	req := func(form url.Values, key string) *http.Request {
+		r := httptest.NewRequest("POST", "/mailout", nil)
+		r.PostForm = form
+		if key != "" {
+			r.Header.Set(headerIdempotencyKey, key)
+		}
+		return r
+	}
+
+	k1, fp1 := mc.idempotencyKey(req(url.Values{"email": {"ken@thompson.email"}, "message": {"Hello"}, csrfField: {"t1"}}, ""))
+	k2, fp2 := mc.idempotencyKey(req(url.Values{"message": {"Hello"}, "email": {"ken@thompson.email"}, csrfField: {"t2"}, "website": {""}}, ""))
+	assert.Exactly(t, k1, k2)
+	assert.Exactly(t, fp1, fp2)
+	assert.True(t, strings.HasPrefix(k1, "hash:192.0.2.1 "))
+
+	_, fp3 := mc.idempotencyKey(req(url.Values{"email": {"ken@thompson.email"}, "message": {"Hello!"}}, ""))
+	assert.NotEqual(t, fp1, fp3)
+	// no ambiguity between keys and values
+	_, fp4 := mc.idempotencyKey(req(url.Values{"ab": {"c"}}, ""))
+	_, fp5 := mc.idempotencyKey(req(url.Values{"a": {"bc"}}, ""))
+	assert.NotEqual(t, fp4, fp5)
+
+	k6, fp6 := mc.idempotencyKey(req(url.Values{"email": {"ken@thompson.email"}, "message": {"Hello"}}, "8e03978e-40d5"))
+	assert.Exactly(t, "key:192.0.2.1 8e03978e-40d5", k6)
+	assert.Exactly(t, fp1, fp6)
+
+	// other clients get other keys for the same submission
+	r7 := req(url.Values{"email": {"ken@thompson.email"}, "message": {"Hello"}}, "8e03978e-40d5")
+	r7.RemoteAddr = "198.51.100.7:4711"
+	k7, fp7 := mc.idempotencyKey(r7)
+	assert.Exactly(t, "key:198.51.100.7 8e03978e-40d5", k7)
+	assert.Exactly(t, fp1, fp7)
+}
+
+func newIdempotentTestHandler(t *testing.T, pipe chan *http.Request) *handler {
+	mc, err := parse(caddy.NewTestController("http", `mailout {
+		idempotency
+		idempotency_window 1m
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHandler(mc, pipe)
+}
+
+func TestServeHTTP_Idempotency(t *testing.T) {
+	pipe := make(chan *http.Request, 10)
+	h := newIdempotentTestHandler(t, pipe)
+
+	post := func(body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/mailout", strings.NewReader(body))
+		req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+		if key != "" {
+			req.Header.Set(headerIdempotencyKey, key)
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	tests := []struct {
+		body, key    string
+		wantCode     int
+		wantBody     string
+		wantReplayed bool
+		wantEnqueued int
+	}{
+		{"email=ken%40thompson.email&message=Hi", "", http.StatusOK, `{"code":200}`, false, 1},
+		{"email=ken%40thompson.email&message=Hi", "", http.StatusOK, `{"code":200}`, true, 1},
+		{"email=ken%40thompson.email&message=Hello", "", http.StatusOK, `{"code":200}`, false, 2},
+		{"email=ken%40thompson.email&message=Ho", "abc", http.StatusOK, `{"code":200}`, false, 3},
+		{"email=ken%40thompson.email&message=Ho", "abc", http.StatusOK, `{"code":200}`, true, 3},
+		{"email=ken%40thompson.email&message=Changed", "abc", StatusUnprocessableEntity, `{"code":422,"error":"Idempotency-Key already used for a different submission"}`, false, 3},
+		{"email=kenthompson.email", "xyz", StatusUnprocessableEntity, `{"code":422,"error":"Invalid email address: \"kenthompson.email\""}`, false, 3},
+		{"email=ken%40thompson.email", "xyz", http.StatusOK, `{"code":200}`, false, 4},
+		{"email=ken%40thompson.email", strings.Repeat("k", 256), http.StatusBadRequest, `{"code":400,"error":"Idempotency-Key too long"}`, false, 4},
+	}
+	for i, test := range tests {
+		w := post(test.body, test.key)
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+		assert.Exactly(t, test.wantReplayed, w.Header().Get(headerIdempotentReplayed) == "true", "Index %d", i)
+		assert.Exactly(t, headerApplicationJSONUTF8, w.Header().Get(headerContentType), "Index %d", i)
+		assert.Len(t, pipe, test.wantEnqueued, "Index %d", i)
+	}
+
+	// the key of another client does not match
+	req := httptest.NewRequest("POST", "/mailout", strings.NewReader("email=ken%40thompson.email&message=Ho"))
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	req.Header.Set(headerIdempotencyKey, "abc")
+	req.RemoteAddr = "198.51.100.7:4711"
+	w := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(headerIdempotentReplayed))
+	assert.Len(t, pipe, 5)
+}
+
+func TestServeHTTP_IdempotencyConcurrent(t *testing.T) {
+	// unbuffered, so the first submission blocks until the mail daemon reads
+	pipe := make(chan *http.Request)
+	h := newIdempotentTestHandler(t, pipe)
+
+	codes := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			req := httptest.NewRequest("POST", "/mailout", strings.NewReader("email=ken%40thompson.email"))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			codes <- w.Body.String() + w.Header().Get(headerIdempotentReplayed)
+		}()
+	}
+
+	<-pipe
+	var have []string
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-codes:
+			have = append(have, c)
+		case <-pipe:
+			t.Fatal("Duplicate submission enqueued")
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timeout")
+		}
+	}
+	assert.Contains(t, have, "{\"code\":200}\n")
+	assert.Contains(t, have, "{\"code\":200}\ntrue")
+}
@@ -0,0 +1,203 @@
+package mailout
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipFileCheckInterval limits how often the modification time of an IP list
+// file gets checked.
+const ipFileCheckInterval = time.Second
+
+// ipList contains IP addresses and CIDR ranges, either static from the
+// Caddyfile or loaded from files. Files get re-read when they change, so tools
+// like fail2ban can update them without a restart.
+type ipList struct {
+	nets  []*net.IPNet
+	files []*ipFile
+	now   func() time.Time
+	// errorf reports errors while re-reading a file.
+	errorf func(format string, v ...interface{})
+}
+
+// ipFile a file containing one IP address or CIDR range per line. Comments
+// start with #.
+type ipFile struct {
+	path string
+
+	mu      sync.RWMutex
+	nets    []*net.IPNet
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// newIPList creates a list from the entries. Each entry is an IP address, a
+// CIDR range or a path to a file. Returns nil without entries. A file which
+// cannot be loaded gets reported but stays on the list and will be loaded as
+// soon as it exists.
+func newIPList(entries []string, errorf func(format string, v ...interface{})) (*ipList, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	l := &ipList{
+		now:    time.Now,
+		errorf: errorf,
+	}
+	var firstErr error
+	for _, e := range entries {
+		if n, ok := parseIPNet(e); ok {
+			l.nets = append(l.nets, n)
+			continue
+		}
+		f := &ipFile{path: e}
+		if err := f.reload(l.now()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		l.files = append(l.files, f)
+	}
+	return l, firstErr
+}
+
+// validateIPEntries returns an error for an entry which is neither an IP
+// address, a CIDR range nor a readable file of valid addresses. A typo like
+// 10.0.0.0/33 must not end up as a missing file and silently allow everyone.
+func validateIPEntries(directive string, entries []string) error {
+	for _, e := range entries {
+		if _, ok := parseIPNet(e); ok {
+			continue
+		}
+		if _, err := os.Stat(e); err != nil {
+			return fmt.Errorf("[mailout] %s: %q is neither an IP address, a CIDR range nor a file: %s", directive, e, err)
+		}
+		if _, err := readIPFile(e); err != nil {
+			return fmt.Errorf("[mailout] %s: %s", directive, err)
+		}
+	}
+	return nil
+}
+
+// contains returns true if the IP is on the list. A nil list contains
+// nothing.
+func (l *ipList) contains(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	now := l.now()
+	for _, f := range l.files {
+		if err := f.reload(now); err != nil && l.errorf != nil {
+			l.errorf("[mailout] %s", err)
+		}
+		if f.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload re-reads the file if its modification time or size has changed. On
+// error the previous list stays active.
+func (f *ipFile) reload(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.checked.IsZero() && now.Sub(f.checked) < ipFileCheckInterval {
+		return nil
+	}
+	f.checked = now
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("Cannot load IP list %q: %s", f.path, err)
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+	nets, err := readIPFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.nets = nets
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *ipFile) contains(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func readIPFile(path string) ([]*net.IPNet, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load IP list %q: %s", path, err)
+	}
+	defer fd.Close()
+
+	var nets []*net.IPNet
+	s := bufio.NewScanner(fd)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		n, ok := parseIPNet(text)
+		if !ok {
+			return nil, fmt.Errorf("Invalid IP address %q in %q on line %d", text, path, line)
+		}
+		nets = append(nets, n)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot load IP list %q: %s", path, err)
+	}
+	return nets, nil
+}
+
+// parseIPNet parses a CIDR range or a single IP address.
+func parseIPNet(s string) (*net.IPNet, bool) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
+
+// isIPAllowed checks the client IP against allow_ips and block_ips. If
+// allow_ips has been set, only those addresses are allowed. block_ips always
+// wins, so single addresses of an allowed range can be blocked.
+func (h *handler) isIPAllowed(r *http.Request) bool {
+	if h.allowIPs == nil && h.blockIPs == nil {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(r))
+	if h.allowIPs != nil && !h.allowIPs.contains(ip) {
+		return false
+	}
+	return !h.blockIPs.contains(ip)
+}
@@ -0,0 +1,136 @@
+package mailout
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPNet(t *testing.T) {
+	tests := []struct {
+		in     string
+		wantOK bool
+		want   string
+	}{
+		{"10.0.0.0/8", true, "10.0.0.0/8"},
+		{"192.168.1.7/24", true, "192.168.1.0/24"},
+		{"127.0.0.1", true, "127.0.0.1/32"},
+		{"2001:db8::/32", true, "2001:db8::/32"},
+		{"::1", true, "::1/128"},
+		{"/etc/mailout/blocked.txt", false, ""},
+		{"300.0.0.1", false, ""},
+	}
+	for i, test := range tests {
+		n, ok := parseIPNet(test.in)
+		assert.Exactly(t, test.wantOK, ok, "Index %d", i)
+		if ok {
+			assert.Exactly(t, test.want, n.String(), "Index %d", i)
+		}
+	}
+}
+
+func TestIPList_FileReload(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(file, []byte("# fail2ban\n203.0.113.7\n198.51.100.0/24 # whole net\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []string
+	l, err := newIPList([]string{"10.0.0.1", file}, func(format string, v ...interface{}) {
+		logged = append(logged, format)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.contains(net.ParseIP("10.0.0.1")))
+	assert.True(t, l.contains(net.ParseIP("203.0.113.7")))
+	assert.True(t, l.contains(net.ParseIP("198.51.100.99")))
+	assert.False(t, l.contains(net.ParseIP("203.0.113.8")))
+	assert.False(t, l.contains(nil))
+
+	if err := os.WriteFile(file, []byte("203.0.113.8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// not checked again within the interval
+	assert.False(t, l.contains(net.ParseIP("203.0.113.8")))
+
+	now = now.Add(ipFileCheckInterval)
+	assert.True(t, l.contains(net.ParseIP("203.0.113.8")))
+	assert.False(t, l.contains(net.ParseIP("203.0.113.7")))
+
+	// an invalid file keeps the previous list
+	if err := os.WriteFile(file, []byte("203.0.113.8\nnot an ip\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(ipFileCheckInterval)
+	assert.True(t, l.contains(net.ParseIP("203.0.113.8")))
+	assert.Len(t, logged, 1)
+
+	var nilList *ipList
+	assert.False(t, nilList.contains(net.ParseIP("203.0.113.8")))
+}
+
+func TestIPList_MissingFile(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "blocked.txt")
+	l, err := newIPList([]string{file}, nil)
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "Cannot load IP list")
+	}
+	assert.False(t, l.contains(net.ParseIP("203.0.113.7")))
+
+	// gets loaded as soon as it exists
+	if err := os.WriteFile(file, []byte("203.0.113.7"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(ipFileCheckInterval)
+	l.now = func() time.Time { return now }
+	assert.True(t, l.contains(net.ParseIP("203.0.113.7")))
+}
+
+func TestServeHTTP_IPFilter(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		allow_ips 192.0.2.0/24, 2001:db8::/32
+		block_ips 192.0.2.66
+	}`)
+
+	tests := []struct {
+		remoteAddr string
+		path       string
+		wantCode   int
+	}{
+		// passes and fails later because of the missing email address
+		{"192.0.2.1:1234", "/mailout", StatusUnprocessableEntity},
+		{"[2001:db8::1]:1234", "/mailout", StatusUnprocessableEntity},
+		{"192.0.2.66:1234", "/mailout", http.StatusForbidden},
+		{"203.0.113.7:1234", "/mailout", http.StatusForbidden},
+		{"unknown", "/mailout", http.StatusForbidden},
+		// other routes do not get filtered
+		{"203.0.113.7:1234", "/", http.StatusTeapot},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code == StatusEmpty {
+			code = w.Code
+		}
+		assert.Exactly(t, test.wantCode, code, "Index %d", i)
+	}
+}
@@ -0,0 +1,100 @@
+package mailout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ctxKeyJSON key to store the decoded JSON body in the request context.
+type ctxKeyJSON struct{}
+
+// isJSONRequest returns true if the body has the content type
+// application/json.
+func isJSONRequest(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get(headerContentType))
+	return err == nil && mt == "application/json"
+}
+
+// parseJSONBody decodes a JSON object and flattens it into r.PostForm and
+// r.Form, so all code reading the form works like for url encoded bodies.
+// Nested objects use dots as separator, e.g. address.city. Arrays of scalars
+// become multiple values of the same key, other arrays use the index, e.g.
+// items.0.name. The decoded data gets stored in the request context and is
+// available as .JSON in the templates.
+func parseJSONBody(r *http.Request) (*http.Request, error) {
+	if r.Body == nil {
+		return r, errors.New("Missing JSON body")
+	}
+	// the size has been limited by limitBody
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return r, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var data map[string]interface{}
+	if err := dec.Decode(&data); err != nil {
+		return r, fmt.Errorf("Invalid JSON body: %s", err)
+	}
+	if data == nil {
+		return r, errors.New("Invalid JSON body: must be an object")
+	}
+
+	form := make(url.Values)
+	flattenJSON("", data, form)
+	r.PostForm = form
+	r.Form = make(url.Values, len(form))
+	for k, v := range form {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	for k, v := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyJSON{}, data)), nil
+}
+
+func flattenJSON(key string, v interface{}, form url.Values) {
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		for k, child := range vt {
+			if key != "" {
+				k = key + "." + k
+			}
+			flattenJSON(k, child, form)
+		}
+	case []interface{}:
+		for i, child := range vt {
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				flattenJSON(key+"."+strconv.Itoa(i), child, form)
+			default:
+				flattenJSON(key, child, form)
+			}
+		}
+	case nil:
+		form.Add(key, "")
+	case string:
+		form.Add(key, vt)
+	case json.Number:
+		form.Add(key, vt.String())
+	case bool:
+		form.Add(key, strconv.FormatBool(vt))
+	}
+}
+
+// jsonFrom returns the decoded JSON body of the request or nil.
+func jsonFrom(ctx context.Context) interface{} {
+	if data, ok := ctx.Value(ctxKeyJSON{}).(map[string]interface{}); ok {
+		return data
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package mailout
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	ttpl "text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		wantForm url.Values
+		wantErr  string
+	}{
+		{`{"email":"ken@thompson.email","age":42,"ok":true,"none":null}`,
+			url.Values{"email": {"ken@thompson.email"}, "age": {"42"}, "ok": {"true"}, "none": {""}}, ""},
+		{`{"address":{"city":"Berkeley","zip":"94720"}}`,
+			url.Values{"address.city": {"Berkeley"}, "address.zip": {"94720"}}, ""},
+		{`{"tags":["go","unix"],"items":[{"name":"a"},{"name":"b","qty":2}]}`,
+			url.Values{"tags": {"go", "unix"}, "items.0.name": {"a"}, "items.1.name": {"b"}, "items.1.qty": {"2"}}, ""},
+		{`{"matrix":[[1,2],[3]]}`,
+			url.Values{"matrix.0": {"1", "2"}, "matrix.1": {"3"}}, ""},
+		{`{}`, url.Values{}, ""},
+		{`["a"]`, nil, "Invalid JSON body: json: cannot unmarshal array into Go value of type map[string]interface {}"},
+		{`null`, nil, "Invalid JSON body: must be an object"},
+		{`{"a":`, nil, "Invalid JSON body: unexpected EOF"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout?q=1", strings.NewReader(test.body))
+		req.Header.Set(headerContentType, "application/json; charset=utf-8")
+		assert.True(t, isJSONRequest(req), "Index %d", i)
+
+		req, err := parseJSONBody(req)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			assert.Nil(t, jsonFrom(req.Context()), "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantForm, req.PostForm, "Index %d", i)
+		assert.Exactly(t, []string{"1"}, req.Form["q"], "Index %d", i)
+		assert.NotNil(t, jsonFrom(req.Context()), "Index %d", i)
+	}
+}
+
+func TestIsJSONRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	assert.False(t, isJSONRequest(req))
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	assert.False(t, isJSONRequest(req))
+	req.Header.Set(headerContentType, "Application/JSON")
+	assert.True(t, isJSONRequest(req))
+}
+
+func TestServeHTTP_JSONBody(t *testing.T) {
+
+	h := newTestHandler(t, `mailout`)
+
+	tests := []struct {
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{`{"firstname":"Ken","email":"ken@thompson.email","address":{"city":"Berkeley"}}`, http.StatusOK, `{"code":200}`},
+		{`{"firstname":"Ken","email":"kenthompson.email"}`, StatusUnprocessableEntity, `{"code":422,"error":"Invalid email address: \"kenthompson.email\""}`},
+		{`[1,2]`, http.StatusBadRequest, `{"code":400,"error":"Invalid JSON body: json: cannot unmarshal array into Go value of type map[string]interface {}"}`},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", strings.NewReader(test.body))
+		req.Header.Set(headerContentType, "application/json")
+		w := httptest.NewRecorder()
+		code, err := h.ServeHTTP(w, req)
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, StatusEmpty, code, "Index %d", i)
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+	}
+}
+
+func TestMessage_RenderJSON(t *testing.T) {
+	mc := newConfig()
+	mc.bodyTpl = ttpl.Must(ttpl.New("").Parse(`{{ .Form.Get "address.city" }} {{ .JSON.address.city }}{{ range .JSON.tags }} {{ . }}{{ end }}`))
+
+	req := httptest.NewRequest("POST", "/mailout", strings.NewReader(`{"address":{"city":"Berkeley"},"tags":["go","unix"]}`))
+	req.Header.Set(headerContentType, "application/json")
+	req, err := parseJSONBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	newMessage(mc, req).renderTemplate(buf)
+	assert.Exactly(t, "Berkeley Berkeley go unix", buf.String())
+}
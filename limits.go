@@ -0,0 +1,60 @@
+package mailout
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"unicode/utf8"
+)
+
+// limitBody restricts the size of url encoded and JSON bodies. Multipart
+// bodies get restricted by parseUploads.
+func limitBody(mc *config, w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil && !isMultipartRequest(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, mc.maxBodySize)
+	}
+}
+
+// isBodyTooLarge returns true if the error has been caused by reaching the
+// limit of http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// checkFormLimits returns the name of the offending field, empty for too many
+// fields, and an error if the form exceeds max_fields or max_field_length. The
+// length of the internal fields like captcha tokens does not get checked.
+func (c *config) checkFormLimits(form url.Values) (string, error) {
+	if c.maxFields > 0 {
+		n := 0
+		for _, values := range form {
+			n += len(values)
+		}
+		if n > c.maxFields {
+			return "", codedError{errCodeTooManyFields, fmt.Sprintf("Too many form fields, maximum %d", c.maxFields)}
+		}
+	}
+	if c.maxFieldLength == 0 {
+		return "", nil
+	}
+
+	internal := c.internalFields()
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		if !containsString(internal, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range form[k] {
+			if utf8.RuneCountInString(v) > c.maxFieldLength {
+				return k, codedError{errCodeFieldTooLong, fmt.Sprintf("Field %q too long, maximum %d characters", k, c.maxFieldLength)}
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,79 @@
+package mailout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFormLimits(t *testing.T) {
+	mc := newConfig()
+	mc.maxFields = 4
+	mc.maxFieldLength = 5
+
+	tests := []struct {
+		form      url.Values
+		wantField string
+		wantErr   string
+	}{
+		{url.Values{"name": {"Ken"}, "email": {"k@t.e"}}, "", ""},
+		{url.Values{"name": {"Ken"}, "tags": {"a", "b", "c", "d"}}, "", "Too many form fields, maximum 4"},
+		{url.Values{"name": {"Kenneth"}, "zip": {"94720-1776"}}, "name", `Field "name" too long, maximum 5 characters`},
+		{url.Values{"name": {"Käthe"}}, "", ""},
+		{url.Values{captchaField: {"a-long-captcha-solution"}, csrfField: {"a-long-csrf-token"}}, "", ""},
+	}
+	for i, test := range tests {
+		field, err := mc.checkFormLimits(test.form)
+		assert.Exactly(t, test.wantField, field, "Index %d", i)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+	}
+
+	// disabled by default
+	_, err := newConfig().checkFormLimits(url.Values{"name": {strings.Repeat("x", 1000)}})
+	assert.NoError(t, err)
+}
+
+func TestServeHTTP_Limits(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		max_body_size    100
+		max_fields       3
+		max_field_length 20
+	}`)
+
+	tests := []struct {
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+	}{
+		{"application/x-www-form-urlencoded", "email=ken%40thompson.email&name=Ken", http.StatusOK,
+			`{"version":2,"code":200}`},
+		{"application/x-www-form-urlencoded", "email=ken%40thompson.email&message=" + strings.Repeat("x", 100), http.StatusRequestEntityTooLarge,
+			`{"version":2,"code":413,"error":"Request body too large","error_code":"payload_too_large"}`},
+		{"application/json", `{"email":"ken@thompson.email","message":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge,
+			`{"version":2,"code":413,"error":"Request body too large","error_code":"payload_too_large"}`},
+		{"application/x-www-form-urlencoded", "email=ken%40thompson.email&a=1&b=2&c=3", StatusUnprocessableEntity,
+			`{"version":2,"code":422,"error":"Too many form fields, maximum 3","error_code":"too_many_fields"}`},
+		{"application/json", `{"email":"ken@thompson.email","message":"` + strings.Repeat("x", 21) + `"}`, StatusUnprocessableEntity,
+			`{"version":2,"code":422,"error":"Field \"message\" too long, maximum 20 characters","error_code":"field_too_long","fields":{"message":["Field \"message\" too long, maximum 20 characters"]}}`},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", strings.NewReader(test.body))
+		req.Header.Set(headerContentType, test.contentType)
+		req.Header.Set("Accept", headerApplicationJSONV2)
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, req)
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+	}
+}
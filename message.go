@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strings"
 
@@ -79,11 +82,34 @@ func (bm message) build() messages {
 		bm.setFrom(msg)
 		bm.renderSubject(msg)
 		bm.bodyUnencrypted(msg)
+		attachUploads(msg, uploadsFrom(bm.r.Context()))
 	}
 
 	return msgs
 }
 
+// plainCopy builds an unencrypted message to all recipients without the
+// uploaded files, e.g. to scan the content.
+func (bm message) plainCopy() *gomail.Message {
+	gm := gomail.NewMessage()
+	to := append([]string{}, bm.mc.to...)
+	for addr := range bm.mc.pgpEmailKeyEntities {
+		if !containsString(to, addr) {
+			to = append(to, addr)
+		}
+	}
+	if len(to) > 0 {
+		gm.SetHeader("To", to...)
+	}
+	if len(bm.mc.cc) > 0 {
+		gm.SetHeader("Cc", bm.mc.cc...)
+	}
+	bm.setFrom(gm)
+	bm.renderSubject(gm)
+	bm.bodyUnencrypted(gm)
+	return gm
+}
+
 // initMessages creates a slice with non-nil message pointers
 func (bm message) initMessages() (msgs messages) {
 	msgs = make(messages, bm.mc.messageCount)
@@ -122,21 +148,36 @@ func (bm message) setFrom(gm *gomail.Message) {
 	gm.SetHeader("From", bm.r.PostFormValue("email"))
 }
 
+// templateData the data available in the subject and body templates. Form
+// and JSON do not contain the internal fields and get filtered by
+// fields_allow and fields_deny.
+type templateData struct {
+	Form    url.Values
+	JSON    interface{}
+	Request *http.Request
+}
+
+func (bm message) templateData() templateData {
+	return templateData{
+		Form:    bm.mc.templateForm(bm.r.PostForm),
+		JSON:    bm.mc.templateJSON(jsonFrom(bm.r.Context())),
+		Request: bm.r,
+	}
+}
+
 func (bm message) renderSubject(gm *gomail.Message) {
 	subjBuf := bufpool.Get()
 	defer bufpool.Put(subjBuf)
 
-	err := bm.mc.subjectTpl.Execute(subjBuf, struct {
-		Form    url.Values
-		Request *http.Request
-	}{
-		Form:    bm.r.PostForm,
-		Request: bm.r,
-	})
+	err := bm.mc.subjectTpl.Execute(subjBuf, bm.templateData())
 	if err != nil {
 		bm.mc.maillog.Errorf("Render Subject Error: %s\nForm: %#v\nWritten: %s", err, bm.r.PostForm, subjBuf)
 	}
-	gm.SetHeader("Subject", subjBuf.String())
+	subject := subjBuf.String()
+	if res, ok := spamResultFrom(bm.r.Context()); ok && res.action == spamActionTag {
+		subject = bm.mc.spamTagPrefix() + subject
+	}
+	gm.SetHeader("Subject", subject)
 }
 
 func (bm message) bodyEncrypted(gm *gomail.Message, pgpTo string) {
@@ -147,7 +188,7 @@ func (bm message) bodyEncrypted(gm *gomail.Message, pgpTo string) {
 	msgBuf := bufpool.Get()
 	defer bufpool.Put(msgBuf)
 
-	bm.renderTemplate(msgBuf)
+	bm.renderEncryptedContent(msgBuf)
 
 	// the next line may crash if the PGP key gets removed ... some how. but the crash is fine
 	w, err := openpgp.Encrypt(pgpBuf, openpgp.EntityList{0: bm.mc.pgpEmailKeyEntities[pgpTo]}, nil, nil, nil)
@@ -190,6 +231,68 @@ func (bm message) bodyEncrypted(gm *gomail.Message, pgpTo string) {
 	)
 }
 
+// renderEncryptedContent writes the content to encrypt. Without uploads it is
+// the rendered template. With uploads it is a multipart/mixed MIME entity
+// containing the rendered template and the files, so that the attachments get
+// encrypted together with the body.
+func (bm message) renderEncryptedContent(buf *bytes.Buffer) {
+	ups := uploadsFrom(bm.r.Context())
+	if len(ups) == 0 {
+		bm.renderTemplate(buf)
+		return
+	}
+
+	mw := multipart.NewWriter(buf)
+	buf.WriteString("Content-Type: multipart/mixed; boundary=\"" + mw.Boundary() + "\"\r\n\r\n")
+
+	contentType := "text/plain; charset=UTF-8"
+	if bm.mc.bodyIsHTML {
+		contentType = "text/html; charset=UTF-8"
+	}
+	tplBuf := bufpool.Get()
+	defer bufpool.Put(tplBuf)
+	bm.renderTemplate(tplBuf)
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		bm.mc.maillog.Errorf("PGP MIME body Error: %s", err)
+		return
+	}
+	qw := quotedprintable.NewWriter(pw)
+	qw.Write(tplBuf.Bytes())
+	qw.Close()
+
+	for _, u := range ups {
+		h := textproto.MIMEHeader(u.mimeHeaders())
+		h.Set("Content-Transfer-Encoding", "base64")
+		if pw, err = mw.CreatePart(h); err != nil {
+			bm.mc.maillog.Errorf("PGP MIME attachment Error: %s", err)
+			return
+		}
+		writeBase64Lines(pw, u.data)
+	}
+	if err := mw.Close(); err != nil {
+		bm.mc.maillog.Errorf("PGP MIME Close Error: %s", err)
+	}
+}
+
+// writeBase64Lines writes data base64 encoded with lines of 76 characters as
+// required by RFC 2045.
+func writeBase64Lines(w io.Writer, data []byte) {
+	const lineLen = 76
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(enc, data)
+	for len(enc) > lineLen {
+		w.Write(enc[:lineLen])
+		w.Write([]byte("\r\n"))
+		enc = enc[lineLen:]
+	}
+	w.Write(enc)
+}
+
 func (bm message) bodyUnencrypted(gm *gomail.Message) {
 	contentType := "text/plain"
 	if bm.mc.bodyIsHTML {
@@ -204,13 +307,7 @@ func (bm message) bodyUnencrypted(gm *gomail.Message) {
 }
 
 func (bm message) renderTemplate(buf *bytes.Buffer) {
-	err := bm.mc.bodyTpl.Execute(buf, struct {
-		Form    url.Values
-		Request *http.Request
-	}{
-		Form:    bm.r.PostForm,
-		Request: bm.r,
-	})
+	err := bm.mc.bodyTpl.Execute(buf, bm.templateData())
 	if err != nil {
 		bm.mc.maillog.Errorf("Render Error: %s\nForm: %#v\nWritten: %s", err, bm.r.PostForm, buf)
 	}
@@ -303,3 +303,35 @@ func BenchmarkMessagePlainPGP(b *testing.B) {
 		buf.Reset()
 	}
 }
+
+func TestMessageRange_FilteredFields(t *testing.T) {
+
+	const caddyFile = `mailout {
+				to              gopher@domain.email
+				body            testdata/mail_range.txt
+				honeypot        website
+				captcha_provider hcaptcha
+				fields_deny     internal_*
+			}`
+
+	buf := new(bytes.Buffer)
+	srv := testMessageServer(t, caddyFile, buf, 1)
+	defer srv.Close()
+
+	data := make(url.Values)
+	data.Set("email", "ken@thompson.email")
+	data.Set("message", "Hello")
+	data.Set("internal_note", "secret")
+	data.Set("website", "")
+	data.Set("h-captcha-response", "token")
+	data.Set(csrfField, "token")
+
+	testDoPost(t, srv.URL, data)
+
+	assert.Contains(t, buf.String(), "email:   [ken@thompson.email]")
+	assert.Contains(t, buf.String(), "message:   [Hello]")
+	assert.NotContains(t, buf.String(), "internal_note")
+	assert.NotContains(t, buf.String(), "website")
+	assert.NotContains(t, buf.String(), "h-captcha-response")
+	assert.NotContains(t, buf.String(), csrfField)
+}
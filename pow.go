@@ -0,0 +1,187 @@
+package mailout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// powChallengeField form field name containing the challenge issued by
+	// the route {endpoint}/pow.
+	powChallengeField = "pow_challenge"
+	// powSolutionField form field name containing the solution found by the
+	// browser.
+	powSolutionField = "pow_solution"
+	// powMaxSolutionLength protects against hashing huge inputs.
+	powMaxSolutionLength = 64
+	// powMaxBits upper limit of the difficulty. A browser needs minutes to
+	// compute 2^28 hashes on average.
+	powMaxBits = 28
+)
+
+var (
+	errPoWMissing = errors.New("Missing proof of work")
+	errPoWInvalid = errors.New("Invalid proof of work challenge")
+	errPoWExpired = errors.New("Proof of work challenge expired")
+	errPoWUsed    = errors.New("Proof of work challenge already used")
+	errPoWWrong   = errors.New("Wrong proof of work solution")
+)
+
+// JSONPoW gets returned by the route {endpoint}/pow. The browser must find a
+// solution, so that the SHA-256 hash of challenge + solution starts with
+// difficulty zero bits.
+type JSONPoW struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+	Algorithm  string `json:"algorithm"`
+}
+
+// proofOfWork issues signed hashcash style challenges and verifies their
+// solutions. The difficulty rises by one bit for each doubling of the issued
+// challenges above the threshold per minute.
+type proofOfWork struct {
+	key           []byte
+	difficulty    int
+	maxDifficulty int
+	threshold     int
+	ttl           time.Duration
+	replay        *replayCache
+	// now can be replaced in tests
+	now func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	issued      int
+}
+
+// newProofOfWork creates the proof of work from the configuration. An empty
+// secret generates a random key which is only valid for the lifetime of the
+// process.
+func newProofOfWork(c *config) *proofOfWork {
+	key := []byte(c.powSecret)
+	if len(key) == 0 {
+		key = randomKey(32)
+	}
+	return &proofOfWork{
+		key:           key,
+		difficulty:    c.powDifficulty,
+		maxDifficulty: c.powMaxDifficulty,
+		threshold:     c.powThreshold,
+		ttl:           c.powTTL,
+		replay:        newReplayCache(),
+		now:           time.Now,
+	}
+}
+
+// currentDifficulty counts the issued challenges and returns the difficulty
+// depending on the load.
+func (pw *proofOfWork) currentDifficulty() int {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	now := pw.now()
+	if now.Sub(pw.windowStart) >= time.Minute {
+		pw.windowStart = now
+		pw.issued = 0
+	}
+	pw.issued++
+
+	d := pw.difficulty
+	if pw.threshold <= 0 {
+		return d
+	}
+	for n := pw.issued / pw.threshold; n > 0 && d < pw.maxDifficulty; n /= 2 {
+		d++
+	}
+	return d
+}
+
+// issue creates a new signed challenge: nonce.difficulty.expiry.signature
+func (pw *proofOfWork) issue() JSONPoW {
+	d := pw.currentDifficulty()
+	payload := base64.RawURLEncoding.EncodeToString(randomKey(16)) +
+		"." + strconv.Itoa(d) +
+		"." + strconv.FormatInt(pw.now().Add(pw.ttl).Unix(), 36)
+	return JSONPoW{
+		Challenge:  payload + "." + hmacSign(pw.key, payload),
+		Difficulty: d,
+		Algorithm:  "sha256",
+	}
+}
+
+// verify checks the signature, expiry and the solution of the challenge. A
+// challenge can only be used once.
+func (pw *proofOfWork) verify(challenge, solution string) error {
+	if challenge == "" || solution == "" {
+		return errPoWMissing
+	}
+	if len(solution) > powMaxSolutionLength {
+		return errPoWWrong
+	}
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return errPoWInvalid
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(hmacSign(pw.key, payload))) {
+		return errPoWInvalid
+	}
+	d, err := strconv.Atoi(parts[1])
+	if err != nil || d < pw.difficulty {
+		return errPoWInvalid
+	}
+	exp, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return errPoWInvalid
+	}
+	now := pw.now().Unix()
+	if now > exp {
+		return errPoWExpired
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+solution))) < d {
+		return errPoWWrong
+	}
+	if pw.replay.seen(parts[0], exp, now) {
+		return errPoWUsed
+	}
+	return nil
+}
+
+func leadingZeroBits(h [sha256.Size]byte) int {
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// servePoW writes a new proof of work challenge.
+func (h *handler) servePoW(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "GET" {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusMethodNotAllowed,
+			Error: http.StatusText(http.StatusMethodNotAllowed),
+		}, w, r)
+	}
+	// issuing challenges raises the difficulty, so a flood of requests would
+	// make the form unusable for everybody.
+	if _, ok := h.rlBucket.TakeMaxDuration(1, h.config.rateLimitInterval); !ok {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusTooManyRequests,
+			Error: http.StatusText(http.StatusTooManyRequests),
+		}, w, r)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return h.writeJSONValue(http.StatusOK, h.pow.issue(), w)
+}
@@ -0,0 +1,156 @@
+package mailout
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// solvePoW brute forces the challenge like the browser does.
+func solvePoW(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		s := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+s))) >= difficulty {
+			return s
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	var h [sha256.Size]byte
+	assert.Exactly(t, 256, leadingZeroBits(h))
+	h[1] = 0x10
+	assert.Exactly(t, 11, leadingZeroBits(h))
+	h[0] = 0x80
+	assert.Exactly(t, 0, leadingZeroBits(h))
+}
+
+func TestProofOfWork_Verify(t *testing.T) {
+
+	mc := newConfig()
+	mc.powDifficulty = 8
+	pw := newProofOfWork(mc)
+	now := time.Now()
+	pw.now = func() time.Time { return now }
+
+	jp := pw.issue()
+	assert.Exactly(t, 8, jp.Difficulty)
+	assert.Exactly(t, "sha256", jp.Algorithm)
+	solution := solvePoW(jp.Challenge, jp.Difficulty)
+	wrong := "x"
+	for leadingZeroBits(sha256.Sum256([]byte(jp.Challenge+wrong))) >= jp.Difficulty {
+		wrong += "x"
+	}
+
+	other := newProofOfWork(mc)
+	weaker := newProofOfWork(&config{powSecret: "s3cr3t", powDifficulty: 1, powTTL: time.Minute})
+
+	tests := []struct {
+		pw        *proofOfWork
+		challenge string
+		solution  string
+		want      error
+	}{
+		{pw, "", solution, errPoWMissing},
+		{pw, jp.Challenge, "", errPoWMissing},
+		{pw, "a.b.c", solution, errPoWInvalid},
+		{pw, jp.Challenge + "x", solution, errPoWInvalid},
+		{other, jp.Challenge, solution, errPoWInvalid},
+		{pw, jp.Challenge, wrong, errPoWWrong},
+		{pw, jp.Challenge, solution, nil},
+		{pw, jp.Challenge, solution, errPoWUsed},
+	}
+	for i, test := range tests {
+		assert.Exactly(t, test.want, test.pw.verify(test.challenge, test.solution), "Index %d", i)
+	}
+
+	// a challenge with a lower difficulty signed with the same key gets
+	// rejected by a stricter configuration.
+	weak := weaker.issue()
+	strict := newProofOfWork(&config{powSecret: "s3cr3t", powDifficulty: 8, powTTL: time.Minute})
+	assert.Exactly(t, errPoWInvalid, strict.verify(weak.Challenge, solvePoW(weak.Challenge, weak.Difficulty)))
+
+	jp = pw.issue()
+	pw.now = func() time.Time { return now.Add(mc.powTTL + time.Second) }
+	assert.Exactly(t, errPoWExpired, pw.verify(jp.Challenge, solvePoW(jp.Challenge, jp.Difficulty)))
+}
+
+func TestProofOfWork_DifficultyRisesUnderLoad(t *testing.T) {
+
+	pw := newProofOfWork(&config{powDifficulty: 10, powMaxDifficulty: 12, powThreshold: 2, powTTL: time.Minute})
+	now := time.Now()
+	pw.now = func() time.Time { return now }
+
+	var got []int
+	for i := 0; i < 9; i++ {
+		got = append(got, pw.issue().Difficulty)
+	}
+	assert.Exactly(t, []int{10, 11, 11, 12, 12, 12, 12, 12, 12}, got)
+
+	// next window
+	pw.now = func() time.Time { return now.Add(time.Minute) }
+	assert.Exactly(t, 10, pw.issue().Difficulty)
+}
+
+func TestServeHTTP_PoW(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		pow
+		pow_difficulty 6
+	}`)
+
+	w := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, httptest.NewRequest("GET", "/mailout/pow", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+	var jp JSONPoW
+	if err := json.NewDecoder(w.Body).Decode(&jp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, 6, jp.Difficulty)
+
+	data := url.Values{"email": []string{"ken@thompson.email"}}
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = data
+
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusForbidden, w.Code)
+	assert.Exactly(t, "{\"code\":403,\"error\":\"Missing proof of work\"}\n", w.Body.String())
+
+	data.Set(powChallengeField, jp.Challenge)
+	data.Set(powSolutionField, solvePoW(jp.Challenge, jp.Difficulty))
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+}
+
+func TestServeHTTP_PoWRateLimit(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		pow
+		ratelimit_interval 1h
+		ratelimit_capacity 2
+	}`)
+
+	// the bucket allows one more request than its capacity
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, httptest.NewRequest("GET", "/mailout/pow", nil)); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, want, w.Code, "Index %d", i)
+	}
+}
@@ -3,17 +3,13 @@ package mailout
 import (
 	"encoding/json"
 	"fmt"
-	"image/color"
+	"net"
 	"net/http"
-	"net/url"
-	"strings"
+	"sync/atomic"
 
 	"github.com/SchumacherFM/mailout/bufpool"
-	"github.com/gorilla/sessions"
-	"github.com/juju/ratelimit"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
-	"github.com/quasoft/memstore"
-	"github.com/steambap/captcha"
+	"github.com/juju/ratelimit"
 )
 
 // StatusUnprocessableEntity gets returned whenever parsing of the form fails.
@@ -29,68 +25,159 @@ const (
 	headerPNG                 = "image/png"
 )
 
-type ReCaptchaResp struct {
-	Success     bool     `json:"success"`
-	ChallengeTs string   `json:"challenge_ts"`
-	Hostname    string   `json:"hostname"`
-	ErrorCodes  []string `json:"error-codes"`
-}
-
 func newHandler(mc *config, mailPipe chan<- *http.Request) *handler {
+	// errors have already been reported by parse() and loadFromEnv()
+	cp, err := newCaptchaProvider(mc)
+	if err != nil {
+		mc.maillog.Errorf("%s", err)
+	}
+	ic, err := newImageCaptcha(mc)
+	if err != nil {
+		mc.maillog.Errorf("[mailout] Captcha: %s", err)
+	}
+	blockIPs, err := newIPList(mc.blockIPs, mc.maillog.Errorf)
+	if err != nil {
+		mc.maillog.Errorf("[mailout] block_ips: %s", err)
+	}
+	allowIPs, err := newIPList(mc.allowIPs, mc.maillog.Errorf)
+	if err != nil {
+		mc.maillog.Errorf("[mailout] allow_ips: %s", err)
+	}
+
+	var dc *emailDNSChecker
+	if mc.emailDNSCheck {
+		dc = newEmailDNSChecker(net.DefaultResolver, mc.emailDNSTimeout, mc.emailDNSCacheTTL)
+	}
+
+	var cc *clamdClient
+	if mc.clamdAddr != "" {
+		cc = newClamdClient(mc.clamdAddr, mc.clamdTimeout)
+	}
+
+	var is *idempotencyStore
+	if mc.idempotency {
+		is = newIdempotencyStore(mc.idempotencyWindow)
+	}
 
 	return &handler{
-		rlBucket: ratelimit.NewBucket(mc.rateLimitInterval, mc.rateLimitCapacity),
-		reqPipe:  mailPipe,
-		config:   mc,
-		memStore: memstore.NewMemStore(
-			[]byte("authkey123"),
-			[]byte("40Rf16fa4d0ba972048{40639e8012?a"),
-		),
+		captchaProvider: cp,
+		rlBucket:        ratelimit.NewBucket(mc.rateLimitInterval, mc.rateLimitCapacity),
+		bayesBucket:     ratelimit.NewBucket(bayesRateLimitInterval, bayesRateLimitCapacity),
+		reqPipe:         mailPipe,
+		config:          mc,
+		timeTrap:        newTimeTrap(mc.timeTrapSecret, mc.timeTrapMinAge, mc.timeTrapMaxAge),
+		csrf:            newCSRFProtector(mc.csrfSecret, len(mc.allowedOrigins) > 0),
+		captcha:         ic,
+		pow:             newProofOfWork(mc),
+		blockIPs:        blockIPs,
+		allowIPs:        allowIPs,
+		emailDNS:        dc,
+		clamd:           cc,
+		idempotency:     is,
 	}
 }
 
 type handler struct {
+	// honeypotDrops counts the submissions which have been dropped because
+	// of a filled out honeypot field. Must be the first field to guarantee
+	// 64-bit alignment for the atomic operations.
+	honeypotDrops uint64
 	// rlBucket rate limit bucket
 	rlBucket *ratelimit.Bucket
+	// bayesBucket rate limit bucket of the route {endpoint}/bayes
+	bayesBucket *ratelimit.Bucket
 	// reqPipe send request to somewhere else. can be nil for testing.
-	reqPipe  chan<- *http.Request
-	config   *config
-	Next     httpserver.Handler
-	memStore *memstore.MemStore
+	reqPipe chan<- *http.Request
+	config  *config
+	Next    httpserver.Handler
+	// captcha built-in image captcha
+	captcha *imageCaptcha
+
+	timeTrap timeTrap
+	csrf     csrfProtector
+	// captchaProvider verifies third party captchas. Nil if disabled.
+	captchaProvider captchaProvider
+	pow             *proofOfWork
+	// blockIPs and allowIPs nil if not configured.
+	blockIPs *ipList
+	allowIPs *ipList
+	// emailDNS nil if disabled.
+	emailDNS *emailDNSChecker
+	// clamd nil if disabled.
+	clamd *clamdClient
+	// idempotency nil if disabled.
+	idempotency *idempotencyStore
 }
 
 // ServeHTTP serves a request
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (_ int, err error) {
-	var session *sessions.Session
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	// ip filter, before the rate limit gets touched
+	if h.isRoute(r.URL.Path) && !h.isIPAllowed(r) {
+		return h.writeJSON(JSONError{
+			Code:      http.StatusForbidden,
+			Error:     http.StatusText(http.StatusForbidden),
+			ErrorCode: errCodeIPBlocked,
+		}, w, r)
+	}
+
+	// cors
+	if len(h.config.allowedOrigins) > 0 && h.isRoute(r.URL.Path) {
+		origin := requestOrigin(r)
+		allowed := h.config.isAllowedOrigin(origin)
+		if !allowed && (r.Method == "POST" || r.Method == "OPTIONS") {
+			return h.writeJSON(JSONError{
+				Code:      http.StatusForbidden,
+				Error:     "Origin not allowed",
+				ErrorCode: errCodeOriginNotAllowed,
+			}, w, r)
+		}
+		if allowed {
+			setCORSHeaders(w.Header(), origin, h.config.isListedOrigin(origin), r.Method == "OPTIONS")
+		}
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return StatusEmpty, nil
+		}
+	}
 
 	// captcha
-	if h.config.Captcha {
-		if r.URL.Path == h.config.endpoint+"/captcha" {
-			data, _ := captcha.New(150, 60, func(o *captcha.Options) {
-				o.BackgroundColor = color.White
-				o.CharPreset = "ABCDEFGHKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
-				o.FontDPI = 82
-				o.CurveNumber = 1
-				o.TextLength = 5
-			})
-			session, err = h.memStore.New(r, "captcha")
-			if err != nil {
-				return h.writeJSON(JSONError{
-					Code:  http.StatusInternalServerError,
-					Error: err.Error(),
-				}, w)
-			}
-			session.Values["captcha"] = data.Text
-			err = h.memStore.Save(r, w, session)
-			if err != nil {
-				return h.writeJSON(JSONError{
-					Code:  http.StatusInternalServerError,
-					Error: err.Error(),
-				}, w)
-			}
-			w.Header().Set(headerContentType, headerPNG)
-			return http.StatusOK, data.WriteImage(w)
+	if h.config.Captcha && r.URL.Path == h.config.endpoint+"/captcha" {
+		return h.serveCaptchaImage(w, r)
+	}
+	if h.config.Captcha && h.config.captchaJSON && r.URL.Path == h.config.endpoint+"/captcha.json" {
+		return h.serveCaptchaJSON(w, r)
+	}
+
+	// proof of work
+	if h.config.pow && r.URL.Path == h.config.endpoint+"/pow" {
+		return h.servePoW(w, r)
+	}
+
+	// bayes admin
+	if h.config.bayesAdminToken != "" && h.config.bayes != nil && r.URL.Path == h.config.endpoint+"/bayes" {
+		return h.serveBayes(w, r)
+	}
+
+	// time trap
+	if h.config.timeTrap && r.URL.Path == h.config.endpoint+"/token" {
+		if r.Method != "GET" {
+			return h.writeJSON(JSONError{
+				Code:  http.StatusMethodNotAllowed,
+				Error: http.StatusText(http.StatusMethodNotAllowed),
+			}, w, r)
 		}
+		return h.writeJSONValue(http.StatusOK, JSONToken{Token: h.timeTrap.issue()}, w)
+	}
+
+	// csrf
+	if h.config.csrf && r.URL.Path == h.config.endpoint+"/csrf" {
+		if r.Method != "GET" {
+			return h.writeJSON(JSONError{
+				Code:  http.StatusMethodNotAllowed,
+				Error: http.StatusText(http.StatusMethodNotAllowed),
+			}, w, r)
+		}
+		return h.writeJSONValue(http.StatusOK, JSONToken{Token: h.csrf.issue(w, h.config.endpoint)}, w)
 	}
 
 	if r.URL.Path != h.config.endpoint {
@@ -101,91 +188,214 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (_ int, err
 		return h.writeJSON(JSONError{
 			Code:  http.StatusMethodNotAllowed,
 			Error: http.StatusText(http.StatusMethodNotAllowed),
-		}, w)
+		}, w, r)
 	}
 
 	if _, ok := h.rlBucket.TakeMaxDuration(1, h.config.rateLimitInterval); !ok {
 		return h.writeJSON(JSONError{
 			Code:  http.StatusTooManyRequests,
 			Error: http.StatusText(http.StatusTooManyRequests),
-		}, w)
+		}, w, r)
 	}
 
-	if err := r.ParseForm(); err != nil {
+	limitBody(h.config, w, r)
+	var err error
+	switch {
+	case isJSONRequest(r):
+		r, err = parseJSONBody(r)
+	case isMultipartRequest(r):
+		if r, err = parseUploads(h.config, w, r); err != nil {
+			return h.writeJSON(err.(uploadError).jsonError(), w, r)
+		}
+	default:
+		err = r.ParseForm()
+	}
+	if isBodyTooLarge(err) {
+		return h.writeJSON(JSONError{
+			Code:  http.StatusRequestEntityTooLarge,
+			Error: "Request body too large",
+		}, w, r)
+	}
+	if err != nil {
 		return h.writeJSON(JSONError{
 			Code:  http.StatusBadRequest,
 			Error: err.Error(),
-		}, w)
+		}, w, r)
+	}
+	if field, err := h.config.checkFormLimits(r.PostForm); err != nil {
+		je := JSONError{
+			Code:      StatusUnprocessableEntity,
+			Error:     err.Error(),
+			ErrorCode: errorCode(err, errCodeUnprocessable),
+		}
+		if field != "" {
+			je.Fields = map[string][]string{field: {err.Error()}}
+		}
+		return h.writeJSON(je, w, r)
 	}
 
-	// captcha
-	if h.config.Captcha {
-		session, err = h.memStore.Get(r, "captcha")
-		if err != nil {
+	if h.idempotency != nil {
+		return h.serveIdempotent(w, r)
+	}
+	return h.serveSubmission(w, r)
+}
+
+// serveSubmission verifies the parsed form and enqueues the email.
+func (h *handler) serveSubmission(w http.ResponseWriter, r *http.Request) (int, error) {
+	// csrf
+	if h.config.csrf {
+		if err := h.csrf.verify(r); err != nil {
 			return h.writeJSON(JSONError{
-				Code:  http.StatusBadRequest,
-				Error: err.Error(),
-			}, w)
-		}
-		text := r.PostFormValue("captcha_text")
-		if correct, ok := session.Values["captcha"].(string); (ok && text != correct) || !ok {
-			session.Values["captcha"] = ""
-			h.memStore.Save(r, w, session)
+				Code:      http.StatusForbidden,
+				Error:     err.Error(),
+				ErrorCode: errCodeCSRFInvalid,
+			}, w, r)
+		}
+	}
+
+	// honeypot: pretend success so bots cannot learn anything
+	if h.config.honeypotField != "" && r.PostFormValue(h.config.honeypotField) != "" {
+		drops := atomic.AddUint64(&h.honeypotDrops, 1)
+		h.config.maillog.Errorf("[mailout] Honeypot field %q filled out by %s. Submission dropped. Total drops: %d", h.config.honeypotField, r.RemoteAddr, drops)
+		return h.writeSuccess(w, r)
+	}
+
+	// time trap
+	if h.config.timeTrap {
+		if err := h.timeTrap.verify(r.PostFormValue(timeTrapField)); err != nil {
 			return h.writeJSON(JSONError{
-				Code:  http.StatusUnauthorized,
-				Error: "Wrong captcha_text: " + text + " Correct: " + correct,
-			}, w)
-		}
-	}
-
-	// recaptcha
-	if h.config.ReCaptcha {
-		RecaptchaText := r.PostFormValue("g-recaptcha-response")
-		httpclient := http.Client{}
-		parts := url.Values{}
-		parts.Set("secret", h.config.ReCaptchaSecret)
-		parts.Set("response", RecaptchaText)
-		parts.Set("remoteip", r.RemoteAddr)
-		r, err := httpclient.PostForm("https://www.google.com/recaptcha/api/siteverify", parts)
-		if err != nil {
+				Code:      http.StatusForbidden,
+				Error:     err.Error(),
+				ErrorCode: errCodeTimeTrapInvalid,
+			}, w, r)
+		}
+	}
+
+	// proof of work
+	if h.config.pow {
+		if err := h.pow.verify(r.PostFormValue(powChallengeField), r.PostFormValue(powSolutionField)); err != nil {
 			return h.writeJSON(JSONError{
-				Code:  http.StatusInternalServerError,
-				Error: err.Error(),
-			}, w)
+				Code:      http.StatusForbidden,
+				Error:     err.Error(),
+				ErrorCode: errCodePoWInvalid,
+			}, w, r)
 		}
-		resp := &ReCaptchaResp{}
-		err = json.NewDecoder(r.Body).Decode(resp)
-		if err != nil {
+	}
+
+	// captcha
+	if h.config.Captcha {
+		if err := h.captcha.verify(w, r, r.PostFormValue(captchaField)); err != nil {
+			code := http.StatusUnauthorized
+			if !isCaptchaError(err) {
+				code = http.StatusBadRequest
+			}
 			return h.writeJSON(JSONError{
-				Code:  http.StatusInternalServerError,
-				Error: err.Error(),
-			}, w)
+				Code:      code,
+				Error:     err.Error(),
+				ErrorCode: captchaErrorCode(err),
+			}, w, r)
 		}
-		if resp.Success != true {
+	}
+
+	// captcha provider: reCAPTCHA, hCaptcha, Turnstile, ...
+	if h.captchaProvider != nil {
+		if err := h.captchaProvider.Verify(r, r.PostFormValue(h.captchaProvider.Field())); err != nil {
+			code, errCode := http.StatusInternalServerError, errCodeCaptchaUnavailable
+			if _, ok := err.(captchaFailure); ok {
+				code, errCode = http.StatusForbidden, errCodeCaptchaFailed
+			}
 			return h.writeJSON(JSONError{
-				Code:  http.StatusInternalServerError,
-				Error: strings.Join(resp.ErrorCodes, "; "),
-			}, w)
+				Code:      code,
+				Error:     err.Error(),
+				ErrorCode: errCode,
+			}, w, r)
 		}
 	}
 
+	// the schema and the email address get validated together, so the
+	// client receives all field errors at once.
+	var errs map[string][]string
+	if len(h.config.fields) > 0 {
+		errs = validateFields(h.config.fields, r.PostForm)
+	}
 	if e := r.PostFormValue("email"); !isValidEmail(e) {
+		if errs == nil {
+			return h.writeJSON(JSONError{
+				Code:      StatusUnprocessableEntity,
+				Error:     fmt.Sprintf("Invalid email address: %q", e),
+				ErrorCode: errCodeInvalidEmail,
+				Fields:    map[string][]string{"email": {msgInvalidEmail}},
+			}, w, r)
+		}
+		// a field of the type email already reports it
+		if !containsString(errs["email"], msgInvalidEmail) {
+			errs["email"] = append(errs["email"], msgInvalidEmail)
+		}
+	}
+	if errs != nil {
+		return h.writeJSON(JSONError{
+			Code:      StatusUnprocessableEntity,
+			Error:     "Invalid form fields",
+			ErrorCode: errCodeInvalidFields,
+			Fields:    errs,
+		}, w, r)
+	}
+	if err := h.config.emailPolicy.check(r.PostFormValue("email")); err != nil {
 		return h.writeJSON(JSONError{
-			Code:  StatusUnprocessableEntity,
-			Error: fmt.Sprintf("Invalid email address: %q", e),
-		}, w)
+			Code:      StatusUnprocessableEntity,
+			Error:     err.Error(),
+			ErrorCode: errorCode(err, errCodeUnprocessable),
+			Fields:    map[string][]string{"email": {err.Error()}},
+		}, w, r)
+	}
+	if h.emailDNS != nil {
+		if temporary, err := h.emailDNS.check(r.PostFormValue("email")); temporary {
+			h.config.maillog.Errorf("[mailout] Email DNS check: %s", err)
+		} else if err != nil {
+			return h.writeJSON(JSONError{
+				Code:      StatusUnprocessableEntity,
+				Error:     err.Error(),
+				ErrorCode: errCodeEmailNoRecords,
+				Fields:    map[string][]string{"email": {err.Error()}},
+			}, w, r)
+		}
 	}
 
-	// captcha
-	if h.config.Captcha {
-		session.Values["captcha"] = ""
-		h.memStore.Save(r, w, session)
+	// spam rules
+	if h.config.spamRules != nil {
+		res := h.config.spamRules.score(r.PostForm, h.config.internalFields())
+		switch res.action {
+		case spamActionReject:
+			h.config.maillog.Errorf("[mailout] Spam rejected from %s. Score %.1f Rules: %v", r.RemoteAddr, res.Score, res.Matches)
+			return h.writeJSON(JSONError{
+				Code:      StatusUnprocessableEntity,
+				Error:     "Submission rejected as spam",
+				ErrorCode: errCodeSpam,
+			}, w, r)
+		case spamActionDrop:
+			h.config.maillog.Errorf("[mailout] Spam dropped from %s. Score %.1f Rules: %v", r.RemoteAddr, res.Score, res.Matches)
+			return h.writeSuccess(w, r)
+		}
+		r = r.WithContext(withSpamResult(r.Context(), res))
+	}
+
+	// virus scan as last check, because it is the most expensive one
+	if ups := uploadsFrom(r.Context()); h.clamd != nil && len(ups) > 0 {
+		if err := h.clamd.scanUploads(ups, h.config.maillog.Errorf); err != nil {
+			return h.writeJSON(err.(uploadError).jsonError(), w, r)
+		}
 	}
 
 	if h.reqPipe != nil {
 		h.reqPipe <- r // might block if the mail daemon is busy
 	}
 
+	return h.writeSuccess(w, r)
+}
+
+// writeSuccess writes the response for an accepted submission and redirects
+// if the redirect field has been configured and submitted.
+func (h *handler) writeSuccess(w http.ResponseWriter, r *http.Request) (int, error) {
 	// redirection
 	if h.config.redirectField != "" {
 		target := r.PostFormValue(h.config.redirectField)
@@ -194,7 +404,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (_ int, err
 		}
 	}
 
-	return h.writeJSON(JSONError{Code: http.StatusOK}, w)
+	return h.writeJSON(JSONError{Code: http.StatusOK}, w, r)
 }
 
 // JSONError defines how an REST JSON looks like.
@@ -205,18 +415,40 @@ type JSONError struct {
 	Code int `json:"code,omitempty"`
 	// Error the underlying error, if there is one.
 	Error string `json:"error,omitempty"`
+	// ErrorCode and Fields are only part of the version 2 response, see
+	// JSONErrorV2.
+	ErrorCode string              `json:"-"`
+	Fields    map[string][]string `json:"-"`
+}
+
+// JSONToken gets returned by the routes which issue tokens.
+type JSONToken struct {
+	Token string `json:"token"`
+}
+
+// writeJSON writes the error in the version requested by the client.
+func (h *handler) writeJSON(je JSONError, w http.ResponseWriter, r *http.Request) (int, error) {
+	if apiVersion(r) == 2 {
+		return h.writeJSONType(je.Code, headerApplicationJSONV2+"; charset=utf-8", je.v2(), w)
+	}
+	return h.writeJSONValue(je.Code, je, w)
+}
+
+// writeJSONValue writes any value JSON encoded with the provided status code.
+func (h *handler) writeJSONValue(code int, v interface{}, w http.ResponseWriter) (int, error) {
+	return h.writeJSONType(code, headerApplicationJSONUTF8, v, w)
 }
 
-func (h *handler) writeJSON(je JSONError, w http.ResponseWriter) (int, error) {
+func (h *handler) writeJSONType(code int, contentType string, v interface{}, w http.ResponseWriter) (int, error) {
 	buf := bufpool.Get()
 	defer bufpool.Put(buf)
 
-	w.Header().Set(headerContentType, headerApplicationJSONUTF8)
+	w.Header().Set(headerContentType, contentType)
 
 	// https://github.com/caddyserver/caddy/issues/637#issuecomment-189599332
-	w.WriteHeader(je.Code)
+	w.WriteHeader(code)
 
-	if err := json.NewEncoder(buf).Encode(je); err != nil {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
 		return http.StatusInternalServerError, err
 	}
 	if _, err := w.Write(buf.Bytes()); err != nil {
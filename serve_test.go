@@ -1,9 +1,11 @@
 package mailout
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -222,3 +224,109 @@ func TestServeHTTP_ShouldNotRedirectWithoutRedirectionField(t *testing.T) {
 	assert.Exactly(t, http.StatusOK, w.Code)
 	assert.Exactly(t, "", w.HeaderMap.Get("Location"))
 }
+
+func TestServeHTTP_HoneypotShouldDropSilently(t *testing.T) {
+
+	c := caddy.NewTestController("http", `mailout {
+		honeypot website
+	}`)
+	mc, err := parse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := make(chan *http.Request, 1)
+	h := newHandler(mc, pipe)
+
+	data := make(url.Values)
+	data.Set("firstname", "Ken")
+	data.Set("email", "ken@thompson.email")
+	data.Set("website", "http://spam.example")
+
+	req, err := http.NewRequest("POST", "/mailout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.PostForm = data
+
+	w := httptest.NewRecorder()
+	code, err := h.ServeHTTP(w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, StatusEmpty, code)
+	assert.Exactly(t, http.StatusOK, w.Code)
+	assert.Exactly(t, "{\"code\":200}\n", w.Body.String())
+	assert.Len(t, pipe, 0)
+	assert.Exactly(t, uint64(1), h.honeypotDrops)
+
+	data.Del("website")
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+	assert.Len(t, pipe, 1)
+	assert.Exactly(t, uint64(1), h.honeypotDrops)
+}
+
+func TestServeHTTP_TimeTrap(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		timetrap
+		timetrap_secret s3cr3t
+		timetrap_min 2s
+	}`)
+
+	req, err := http.NewRequest("GET", "/mailout/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	code, err := h.ServeHTTP(w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, StatusEmpty, code)
+	assert.Exactly(t, http.StatusOK, w.Code)
+	assert.Exactly(t, headerApplicationJSONUTF8, w.HeaderMap.Get(headerContentType))
+
+	var jt JSONToken
+	if err := json.NewDecoder(w.Body).Decode(&jt); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.Contains(jt.Token, "."), "Token: %q", jt.Token)
+
+	data := make(url.Values)
+	data.Set("email", "ken@thompson.email")
+	data.Set(timeTrapField, jt.Token)
+	req, err = http.NewRequest("POST", "/mailout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.PostForm = data
+
+	// submitted immediately
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusForbidden, w.Code)
+	assert.Exactly(t, "{\"code\":403,\"error\":\"Form submitted too fast\"}\n", w.Body.String())
+
+	// submitted after a human like delay
+	h.timeTrap.now = func() time.Time { return time.Now().Add(time.Second * 5) }
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusOK, w.Code)
+
+	// forged token
+	data.Set(timeTrapField, "1234.abcd")
+	w = httptest.NewRecorder()
+	if _, err := h.ServeHTTP(w, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, http.StatusForbidden, w.Code)
+	assert.Exactly(t, "{\"code\":403,\"error\":\"Invalid time trap token\"}\n", w.Body.String())
+}
@@ -2,6 +2,9 @@ package mailout
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"path"
 	"strconv"
 	"time"
 
@@ -38,6 +41,15 @@ func setup(c *caddy.Controller) error {
 		if err = mc.loadTemplate(); err != nil {
 			return err
 		}
+		if err = mc.loadEmailPolicy(); err != nil {
+			return err
+		}
+		if err = mc.loadBayes(); err != nil {
+			return err
+		}
+		if err = mc.loadSpamRules(); err != nil {
+			return err
+		}
 		if err = mc.pingSMTP(); err != nil {
 			return err
 		}
@@ -147,6 +159,55 @@ func parse(c *caddy.Controller) (mc *config, _ error) {
 					return nil, c.ArgErr()
 				}
 				mc.body = c.Val()
+			case "autoreply_subject":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.autoreplySubject = c.Val()
+			case "autoreply_body":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.autoreplyBody = c.Val()
+			case "autoreply_from_email":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.autoreplyFromEmail = c.Val()
+			case "autoreply_from_name":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.autoreplyFromName = c.Val()
+			case "autoreply_interval":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.autoreplyInterval, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "autoreply_max":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.autoreplyMax, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+				if mc.autoreplyMax < 0 {
+					return nil, errors.New("[mailout] autoreply_max must not be negative")
+				}
+			case "autoreply_fields":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				patterns := splitList(args)
+				for _, p := range patterns {
+					if _, err := path.Match(p, ""); err != nil {
+						return nil, fmt.Errorf("[mailout] Invalid autoreply_fields pattern %q: %s", p, err)
+					}
+				}
+				mc.autoreplyFields = append(mc.autoreplyFields, patterns...)
 			case "username":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -174,8 +235,278 @@ func parse(c *caddy.Controller) (mc *config, _ error) {
 					return nil, c.ArgErr()
 				}
 				mc.redirectField = c.Val()
+			case "honeypot":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.honeypotField = c.Val()
+			case "timetrap":
+				mc.timeTrap = true
+			case "timetrap_secret":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.timeTrapSecret = c.Val()
+			case "csrf":
+				mc.csrf = true
+			case "csrf_secret":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.csrfSecret = c.Val()
+			case "block_ips", "allow_ips":
+				dir := c.Val()
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				entries := splitList(args)
+				if dir == "block_ips" {
+					mc.blockIPs = append(mc.blockIPs, entries...)
+				} else {
+					mc.allowIPs = append(mc.allowIPs, entries...)
+				}
+			case "field":
+				f, err := parseFormField(c)
+				if err != nil {
+					return nil, err
+				}
+				mc.fields = append(mc.fields, f)
+			case "fields_allow", "fields_deny":
+				dir := c.Val()
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				patterns := splitList(args)
+				for _, p := range patterns {
+					if _, err := path.Match(p, ""); err != nil {
+						return nil, fmt.Errorf("[mailout] Invalid %s pattern %q: %s", dir, p, err)
+					}
+				}
+				if dir == "fields_allow" {
+					mc.fieldsAllow = append(mc.fieldsAllow, patterns...)
+				} else {
+					mc.fieldsDeny = append(mc.fieldsDeny, patterns...)
+				}
+			case "email_allow", "email_block":
+				dir := c.Val()
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				entries := splitList(args)
+				if dir == "email_allow" {
+					mc.emailAllow = append(mc.emailAllow, entries...)
+				} else {
+					mc.emailBlock = append(mc.emailBlock, entries...)
+				}
+			case "email_dns_check":
+				mc.emailDNSCheck = true
+			case "email_dns_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.emailDNSTimeout, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "email_dns_cache_ttl":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.emailDNSCacheTTL, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "email_disposable":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.emailDisposable = c.Val()
+			case "max_body_size":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.maxBodySize, err = parseByteSize(c.Val()); err != nil {
+					return nil, err
+				}
+				if mc.maxBodySize == 0 {
+					return nil, errors.New("[mailout] max_body_size must be greater than 0")
+				}
+			case "max_fields", "max_field_length":
+				dir := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				var n int
+				if n, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+				if n < 0 {
+					return nil, fmt.Errorf("[mailout] %s must not be negative", dir)
+				}
+				if dir == "max_fields" {
+					mc.maxFields = n
+				} else {
+					mc.maxFieldLength = n
+				}
+			case "idempotency":
+				mc.idempotency = true
+			case "idempotency_window":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.idempotencyWindow, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+				if mc.idempotencyWindow <= 0 {
+					return nil, errors.New("[mailout] idempotency_window must be greater than 0")
+				}
+			case "upload_max_files":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.uploadMaxFiles, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "upload_max_file_size", "upload_max_total_size":
+				dir := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				var size int64
+				if size, err = parseByteSize(c.Val()); err != nil {
+					return nil, err
+				}
+				if dir == "upload_max_file_size" {
+					mc.uploadMaxFileSize = size
+				} else {
+					mc.uploadMaxTotalSize = size
+				}
+			case "upload_types":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				mc.uploadTypes = splitList(args)
+			case "clamd":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.clamdAddr = c.Val()
+			case "clamd_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.clamdTimeout, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "allowed_origins":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, a := range args {
+					mc.allowedOrigins = append(mc.allowedOrigins, splitOrigins(a)...)
+				}
+			case "timetrap_min":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.timeTrapMinAge, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
+			case "timetrap_max":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.timeTrapMaxAge, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
 			case "captcha":
 				mc.Captcha = true
+			case "captcha_size":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaWidth, err = strconv.Atoi(args[0]); err != nil {
+					return nil, err
+				}
+				if mc.captchaHeight, err = strconv.Atoi(args[1]); err != nil {
+					return nil, err
+				}
+			case "captcha_length":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaLength, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "captcha_charset":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaCharset = c.Val()
+			case "captcha_noise":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaNoise, err = strconv.ParseFloat(c.Val(), 64); err != nil {
+					return nil, err
+				}
+			case "captcha_curves":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaCurves, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "captcha_stateless":
+				mc.captchaStateless = true
+			case "captcha_replay_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaReplayDir = c.Val()
+				if fi, err := os.Stat(mc.captchaReplayDir); err != nil || !fi.IsDir() {
+					return nil, fmt.Errorf("[mailout] captcha_replay_dir %q is not a directory", mc.captchaReplayDir)
+				}
+			case "captcha_json":
+				mc.captchaJSON = true
+			case "captcha_question":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				mc.captchaQuestions = append(mc.captchaQuestions, captchaQuestion{text: args[0], answers: args[1:]})
+			case "captcha_ignore_case":
+				mc.captchaIgnoreCase = true
+			case "captcha_ttl":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaTTL, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "captcha_max_attempts":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.captchaMaxAttempts, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "captcha_auth_key":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaAuthKey = c.Val()
+			case "captcha_encryption_key":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaEncKey = c.Val()
 			case "recaptcha":
 				mc.ReCaptcha = true
 			case "recaptcha_secret":
@@ -183,6 +514,133 @@ func parse(c *caddy.Controller) (mc *config, _ error) {
 					return nil, c.ArgErr()
 				}
 				mc.ReCaptchaSecret = c.Val()
+			case "captcha_provider":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaProvider = c.Val()
+			case "captcha_secret":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaSecret = c.Val()
+			case "captcha_verify_url":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaVerifyURL = c.Val()
+			case "captcha_field":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaField = c.Val()
+			case "captcha_hostname":
+				mc.captchaHostnames = c.RemainingArgs()
+				if len(mc.captchaHostnames) == 0 {
+					return nil, c.ArgErr()
+				}
+			case "captcha_max_age":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaMaxAge, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
+			case "recaptcha_min_score":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaMinScore, err = strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return nil, err
+				}
+			case "recaptcha_action":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.captchaAction = c.Val()
+			case "pow":
+				mc.pow = true
+			case "pow_secret":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.powSecret = c.Val()
+			case "pow_difficulty":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.powDifficulty, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "pow_max_difficulty":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.powMaxDifficulty, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "pow_threshold":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.powThreshold, err = strconv.Atoi(c.Val()); err != nil {
+					return nil, err
+				}
+			case "pow_ttl":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.powTTL, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "spam_rules":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.spamRulesFile = c.Val()
+			case "bayes_ham":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.bayesHamDir = c.Val()
+			case "bayes_spam":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.bayesSpamDir = c.Val()
+			case "bayes_admin_token":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.bayesAdminToken = c.Val()
+			case "spamd":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mc.spamdAddr = c.Val()
+			case "spamd_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.spamdTimeout, err = time.ParseDuration(c.Val()); err != nil {
+					return nil, err
+				}
+			case "spamd_tag":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.spamdTag, err = strconv.ParseFloat(c.Val(), 64); err != nil {
+					return nil, err
+				}
+			case "spamd_reject":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if mc.spamdReject, err = strconv.ParseFloat(c.Val(), 64); err != nil {
+					return nil, err
+				}
 			case "ratelimit_interval":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -219,5 +677,74 @@ func parse(c *caddy.Controller) (mc *config, _ error) {
 			}
 		}
 	}
+	if err := validateIPEntries("block_ips", mc.blockIPs); err != nil {
+		return nil, err
+	}
+	if err := validateIPEntries("allow_ips", mc.allowIPs); err != nil {
+		return nil, err
+	}
+	if mc.csrf && containsString(mc.allowedOrigins, "*") {
+		return nil, errors.New("[mailout] allowed_origins * cannot be used with csrf, list the origins")
+	}
+	if mc.timeTrapMinAge < 0 || mc.timeTrapMaxAge < 0 {
+		return nil, errors.New("[mailout] timetrap_min and timetrap_max must not be negative")
+	}
+	// a timetrap_max of 0 disables the maximum age
+	if mc.timeTrapMaxAge > 0 && mc.timeTrapMinAge > mc.timeTrapMaxAge {
+		return nil, fmt.Errorf("[mailout] timetrap_min %s must not be greater than timetrap_max %s", mc.timeTrapMinAge, mc.timeTrapMaxAge)
+	}
+	switch {
+	case mc.captchaWidth <= 0 || mc.captchaHeight <= 0:
+		return nil, errors.New("[mailout] captcha_size must be greater than 0")
+	case mc.captchaLength <= 0:
+		return nil, errors.New("[mailout] captcha_length must be greater than 0")
+	case mc.captchaCharset == "":
+		return nil, errors.New("[mailout] captcha_charset must not be empty")
+	case mc.captchaNoise < 0 || mc.captchaCurves < 0:
+		return nil, errors.New("[mailout] captcha_noise and captcha_curves must not be negative")
+	case mc.captchaTTL <= 0:
+		return nil, errors.New("[mailout] captcha_ttl must be greater than 0")
+	case mc.captchaMaxAttempts <= 0:
+		return nil, errors.New("[mailout] captcha_max_attempts must be greater than 0")
+	}
+	switch {
+	case mc.powDifficulty < 1 || mc.powDifficulty > powMaxBits:
+		return nil, fmt.Errorf("[mailout] pow_difficulty must be between 1 and %d", powMaxBits)
+	case mc.powMaxDifficulty < mc.powDifficulty || mc.powMaxDifficulty > powMaxBits:
+		return nil, fmt.Errorf("[mailout] pow_max_difficulty must be between pow_difficulty and %d", powMaxBits)
+	case mc.powThreshold < 0:
+		return nil, errors.New("[mailout] pow_threshold must not be negative")
+	case mc.powTTL <= 0:
+		return nil, errors.New("[mailout] pow_ttl must be greater than 0")
+	}
+	if mc.captchaMinScore < 0 || mc.captchaMinScore > 1 {
+		return nil, fmt.Errorf("[mailout] recaptcha_min_score %v must be between 0 and 1", mc.captchaMinScore)
+	}
+	if mc.captchaJSON && !mc.Captcha {
+		return nil, errors.New("[mailout] captcha_json requires captcha")
+	}
+	// the in memory replay cache of a single instance would allow to use a
+	// token once on each instance.
+	if mc.captchaStateless && mc.captchaReplayDir == "" {
+		return nil, errors.New("[mailout] captcha_stateless requires captcha_replay_dir, a directory shared by all instances")
+	}
+	if len(mc.captchaQuestions) > 0 && !mc.captchaJSON {
+		return nil, errors.New("[mailout] captcha_question requires captcha_json")
+	}
+	if _, err := newCaptchaProvider(mc); err != nil {
+		return nil, err
+	}
+	if (mc.bayesHamDir == "") != (mc.bayesSpamDir == "") {
+		return nil, errors.New("[mailout] bayes_ham and bayes_spam must be set both")
+	}
+	if mc.bayesAdminToken != "" && mc.bayesHamDir == "" {
+		return nil, errors.New("[mailout] bayes_admin_token requires bayes_ham and bayes_spam")
+	}
+	if md := mc.maillog.MailDir; mc.bayesAdminToken != "" && (md == "" || md == "stdout" || md == "stderr") {
+		return nil, errors.New("[mailout] bayes_admin_token requires a maillog directory")
+	}
+	if mc.autoreplyBody != "" && mc.autoreplyFromEmail == "" && mc.fromEmail == "" {
+		return nil, errors.New("[mailout] autoreply_body requires autoreply_from_email or from_email")
+	}
 	return
 }
@@ -2,6 +2,7 @@ package mailout
 
 import (
 	"errors"
+	"regexp"
 	"testing"
 	"time"
 
@@ -297,6 +298,726 @@ func TestSetupParse(t *testing.T) {
 				return c
 			},
 		},
+		{
+			`mailout {
+				honeypot website
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.honeypotField = "website"
+				return c
+			},
+		},
+		{
+			`mailout {
+				honeypot
+			}`,
+			errors.New("Testfile:2 - Error during parsing: Wrong argument count or unexpected line ending after 'honeypot'"),
+			func() *config {
+				return newConfig()
+			},
+		},
+		{
+			`mailout {
+				timetrap
+				timetrap_secret ENV:MY_TIMETRAP_SECRET
+				timetrap_min 5s
+				timetrap_max 30m
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.timeTrap = true
+				c.timeTrapSecret = "ENV:MY_TIMETRAP_SECRET"
+				c.timeTrapMinAge = time.Second * 5
+				c.timeTrapMaxAge = time.Minute * 30
+				return c
+			},
+		},
+		{
+			`mailout {
+				timetrap
+				timetrap_min 3h
+			}`,
+			errors.New("[mailout] timetrap_min 3h0m0s must not be greater than timetrap_max 2h0m0s"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				timetrap
+				timetrap_min 2s
+				timetrap_max 0
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.timeTrap = true
+				c.timeTrapMinAge = time.Second * 2
+				c.timeTrapMaxAge = 0
+				return c
+			},
+		},
+		{
+			`mailout {
+				timetrap
+				timetrap_min -2s
+			}`,
+			errors.New("[mailout] timetrap_min and timetrap_max must not be negative"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				csrf
+				csrf_secret ENV:MY_CSRF_SECRET
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.csrf = true
+				c.csrfSecret = "ENV:MY_CSRF_SECRET"
+				return c
+			},
+		},
+		{
+			`mailout {
+				allowed_origins https://www.example.com "https://a.example, https://b.example"
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.allowedOrigins = []string{"https://www.example.com", "https://a.example", "https://b.example"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				allowed_origins
+			}`,
+			errors.New("Testfile:2 - Error during parsing: Wrong argument count or unexpected line ending after 'allowed_origins'"),
+			func() *config {
+				return newConfig()
+			},
+		},
+		{
+			`mailout {
+				csrf
+				allowed_origins *
+			}`,
+			errors.New("[mailout] allowed_origins * cannot be used with csrf, list the origins"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha_provider   turnstile
+				captcha_secret     ENV:MY_TURNSTILE_SECRET
+				captcha_verify_url http://127.0.0.1:8080/siteverify
+				captcha_field      turnstile
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.captchaProvider = "turnstile"
+				c.captchaSecret = "ENV:MY_TURNSTILE_SECRET"
+				c.captchaVerifyURL = "http://127.0.0.1:8080/siteverify"
+				c.captchaField = "turnstile"
+				return c
+			},
+		},
+		{
+			`mailout {
+				captcha_provider    recaptcha_v3
+				captcha_hostname    www.example.com example.com
+				captcha_max_age     2m
+				recaptcha_min_score 0.7
+				recaptcha_action    contact
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.captchaProvider = "recaptcha_v3"
+				c.captchaHostnames = []string{"www.example.com", "example.com"}
+				c.captchaMaxAge = time.Minute * 2
+				c.captchaMinScore = 0.7
+				c.captchaAction = "contact"
+				return c
+			},
+		},
+		{
+			`mailout {
+				captcha_provider    recaptcha_v3
+				recaptcha_min_score 1.5
+			}`,
+			errors.New("[mailout] recaptcha_min_score 1.5 must be between 0 and 1"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_size           300 100
+				captcha_length         6
+				captcha_charset        ABCDEF123456
+				captcha_noise          2.5
+				captcha_curves         3
+				captcha_ignore_case
+				captcha_ttl            5m
+				captcha_max_attempts   5
+				captcha_auth_key       ENV:MY_CAPTCHA_AUTH_KEY
+				captcha_encryption_key ENV:MY_CAPTCHA_ENC_KEY
+				captcha_stateless
+				captcha_replay_dir     testdata
+				captcha_json
+				captcha_question       "What is the name of our town?" Berlin "Berlin-Mitte"
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.Captcha = true
+				c.captchaWidth = 300
+				c.captchaHeight = 100
+				c.captchaLength = 6
+				c.captchaCharset = "ABCDEF123456"
+				c.captchaNoise = 2.5
+				c.captchaCurves = 3
+				c.captchaIgnoreCase = true
+				c.captchaTTL = time.Minute * 5
+				c.captchaMaxAttempts = 5
+				c.captchaAuthKey = "ENV:MY_CAPTCHA_AUTH_KEY"
+				c.captchaEncKey = "ENV:MY_CAPTCHA_ENC_KEY"
+				c.captchaStateless = true
+				c.captchaReplayDir = "testdata"
+				c.captchaJSON = true
+				c.captchaQuestions = []captchaQuestion{{text: "What is the name of our town?", answers: []string{"Berlin", "Berlin-Mitte"}}}
+				return c
+			},
+		},
+		{
+			`mailout {
+				captcha_json
+			}`,
+			errors.New("[mailout] captcha_json requires captcha"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_stateless
+				captcha_encryption_key 0123456789abcdef
+			}`,
+			errors.New("[mailout] captcha_stateless requires captcha_replay_dir, a directory shared by all instances"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_stateless
+				captcha_replay_dir testdata/mail_tpl.txt
+			}`,
+			errors.New(`[mailout] captcha_replay_dir "testdata/mail_tpl.txt" is not a directory`),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_question "What is the name of our town?" Berlin
+			}`,
+			errors.New("[mailout] captcha_question requires captcha_json"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_size 0 60
+			}`,
+			errors.New("[mailout] captcha_size must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_length -1
+			}`,
+			errors.New("[mailout] captcha_length must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_charset ""
+			}`,
+			errors.New("[mailout] captcha_charset must not be empty"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_noise -1
+			}`,
+			errors.New("[mailout] captcha_noise and captcha_curves must not be negative"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_ttl 0s
+			}`,
+			errors.New("[mailout] captcha_ttl must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha
+				captcha_max_attempts 0
+			}`,
+			errors.New("[mailout] captcha_max_attempts must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				captcha_size 300
+			}`,
+			errors.New("Testfile:2 - Error during parsing: Wrong argument count or unexpected line ending after '300'"),
+			func() *config {
+				return newConfig()
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_secret         ENV:MY_POW_SECRET
+				pow_difficulty     16
+				pow_max_difficulty 20
+				pow_threshold      100
+				pow_ttl            5m
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.pow = true
+				c.powSecret = "ENV:MY_POW_SECRET"
+				c.powDifficulty = 16
+				c.powMaxDifficulty = 20
+				c.powThreshold = 100
+				c.powTTL = time.Minute * 5
+				return c
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_difficulty 0
+			}`,
+			errors.New("[mailout] pow_difficulty must be between 1 and 28"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_difficulty 64
+			}`,
+			errors.New("[mailout] pow_difficulty must be between 1 and 28"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_max_difficulty 10
+			}`,
+			errors.New("[mailout] pow_max_difficulty must be between pow_difficulty and 28"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_threshold -1
+			}`,
+			errors.New("[mailout] pow_threshold must not be negative"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				pow
+				pow_ttl -1m
+			}`,
+			errors.New("[mailout] pow_ttl must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				spam_rules testdata/spam_rules.json
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.spamRulesFile = "testdata/spam_rules.json"
+				return c
+			},
+		},
+		{
+			`mailout {
+				spamd         unix:/var/run/spamd.sock
+				spamd_timeout 3s
+				spamd_tag     5.5
+				spamd_reject  12
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.spamdAddr = "unix:/var/run/spamd.sock"
+				c.spamdTimeout = time.Second * 3
+				c.spamdTag = 5.5
+				c.spamdReject = 12
+				return c
+			},
+		},
+		{
+			`mailout {
+				spamd_reject high
+			}`,
+			errors.New(`strconv.ParseFloat: parsing "high": invalid syntax`),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				bayes_ham         /var/mailout/ham
+				bayes_spam        /var/mailout/spam
+				bayes_admin_token ENV:MAILOUT_BAYES_TOKEN
+				maillog           /var/mailout/log
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.maillog.MailDir = "/var/mailout/log"
+				c.bayesHamDir = "/var/mailout/ham"
+				c.bayesSpamDir = "/var/mailout/spam"
+				c.bayesAdminToken = "ENV:MAILOUT_BAYES_TOKEN"
+				return c
+			},
+		},
+		{
+			`mailout {
+				bayes_ham /var/mailout/ham
+			}`,
+			errors.New("[mailout] bayes_ham and bayes_spam must be set both"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				bayes_admin_token s3cr3t
+			}`,
+			errors.New("[mailout] bayes_admin_token requires bayes_ham and bayes_spam"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				bayes_ham         /var/mailout/ham
+				bayes_spam        /var/mailout/spam
+				bayes_admin_token s3cr3t
+				maillog           stdout
+			}`,
+			errors.New("[mailout] bayes_admin_token requires a maillog directory"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				block_ips 10.0.0.0/8, 192.168.1.1 testdata/blocked_ips.txt
+				block_ips ::1
+				allow_ips 192.168.0.0/16
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.blockIPs = []string{"10.0.0.0/8", "192.168.1.1", "testdata/blocked_ips.txt", "::1"}
+				c.allowIPs = []string{"192.168.0.0/16"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				block_ips 10.0.0.0/33
+			}`,
+			errors.New(`[mailout] block_ips: "10.0.0.0/33" is neither an IP address, a CIDR range nor a file: stat 10.0.0.0/33: no such file or directory`),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				allow_ips testdata/mail_tpl.txt
+			}`,
+			errors.New(`[mailout] allow_ips: Invalid IP address "This shows the content of a text template." in "testdata/mail_tpl.txt" on line 1`),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				block_ips
+			}`,
+			errors.New("Testfile:2 - Error during parsing: Wrong argument count or unexpected line ending after 'block_ips'"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				email_allow      "company.tld, partner.tld"
+				email_block      spam.tld bad@company.tld
+				email_disposable testdata/disposable_domains.txt
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.emailAllow = []string{"company.tld", "partner.tld"}
+				c.emailBlock = []string{"spam.tld", "bad@company.tld"}
+				c.emailDisposable = "testdata/disposable_domains.txt"
+				return c
+			},
+		},
+		{
+			`mailout {
+				email_dns_check
+				email_dns_timeout   1s
+				email_dns_cache_ttl 30m
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.emailDNSCheck = true
+				c.emailDNSTimeout = time.Second
+				c.emailDNSCacheTTL = time.Minute * 30
+				return c
+			},
+		},
+		{
+			`mailout {
+				field name {
+					required
+					max_length 50
+					regex      "^[a-z]+$"
+				}
+				field topic {
+					type    select
+					options "sales, support"
+					default support
+				}
+				to reply@domain.tld
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.fields = []*formField{
+					{name: "name", typ: fieldText, required: true, maxLength: 50, re: regexp.MustCompile("^[a-z]+$")},
+					{name: "topic", typ: fieldSelect, options: []string{"sales", "support"}, def: "support"},
+				}
+				c.to = []string{"reply@domain.tld"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				upload_max_files      3
+				upload_max_file_size  2MB
+				upload_max_total_size 5MB
+				upload_types          application/pdf image/*
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.uploadMaxFiles = 3
+				c.uploadMaxFileSize = 2 << 20
+				c.uploadMaxTotalSize = 5 << 20
+				c.uploadTypes = []string{"application/pdf", "image/*"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				clamd         unix:/var/run/clamav/clamd.ctl
+				clamd_timeout 1m
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.clamdAddr = "unix:/var/run/clamav/clamd.ctl"
+				c.clamdTimeout = time.Minute
+				return c
+			},
+		},
+		{
+			`mailout {
+				max_body_size    64KB
+				max_fields       20
+				max_field_length 5000
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.maxBodySize = 64 << 10
+				c.maxFields = 20
+				c.maxFieldLength = 5000
+				return c
+			},
+		},
+		{
+			`mailout {
+				max_field_length -1
+			}`,
+			errors.New("[mailout] max_field_length must not be negative"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				max_body_size 0KB
+			}`,
+			errors.New("[mailout] max_body_size must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				fields_allow "name, email, address.*"
+				fields_deny  address.internal
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.fieldsAllow = []string{"name", "email", "address.*"}
+				c.fieldsDeny = []string{"address.internal"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				fields_deny "[a-"
+			}`,
+			errors.New(`[mailout] Invalid fields_deny pattern "[a-": syntax error in pattern`),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				idempotency
+				idempotency_window 30s
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.idempotency = true
+				c.idempotencyWindow = time.Second * 30
+				return c
+			},
+		},
+		{
+			`mailout {
+				idempotency
+				idempotency_window 0s
+			}`,
+			errors.New("[mailout] idempotency_window must be greater than 0"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				autoreply_body       testdata/mail_autoreply.txt
+				autoreply_subject    "We received your message"
+				autoreply_from_email noreply@domain.email
+				autoreply_from_name  "Domain Support"
+				autoreply_interval   24h
+				autoreply_max        20
+				autoreply_fields     "name, company"
+			}`,
+			nil,
+			func() *config {
+				c := newConfig()
+				c.autoreplyBody = "testdata/mail_autoreply.txt"
+				c.autoreplySubject = "We received your message"
+				c.autoreplyFromEmail = "noreply@domain.email"
+				c.autoreplyFromName = "Domain Support"
+				c.autoreplyInterval = time.Hour * 24
+				c.autoreplyMax = 20
+				c.autoreplyFields = []string{"name", "company"}
+				return c
+			},
+		},
+		{
+			`mailout {
+				autoreply_body testdata/mail_autoreply.txt
+			}`,
+			errors.New("[mailout] autoreply_body requires autoreply_from_email or from_email"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				autoreply_max -1
+			}`,
+			errors.New("[mailout] autoreply_max must not be negative"),
+			func() *config {
+				return nil
+			},
+		},
+		{
+			`mailout {
+				upload_max_file_size 2TB
+			}`,
+			errors.New(`[mailout] Invalid size "2TB"`),
+			func() *config {
+				return nil
+			},
+		},
 		{
 			`mailout {
 				ratelimit_interval 12h
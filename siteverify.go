@@ -0,0 +1,230 @@
+package mailout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Names of the supported captcha providers.
+const (
+	providerReCaptcha   = "recaptcha"
+	providerReCaptchaV3 = "recaptcha_v3"
+	providerHCaptcha    = "hcaptcha"
+	providerTurnstile   = "turnstile"
+	providerCustom      = "custom"
+)
+
+// captchaProvider verifies the response token of a third party captcha
+// service which the browser has submitted with the form.
+type captchaProvider interface {
+	// Field returns the name of the form field containing the response token.
+	Field() string
+	// Verify checks the response token with the provider. A nil error means
+	// a human has solved the challenge.
+	Verify(r *http.Request, response string) error
+}
+
+// providerDefaults contains the verify URL and the form field of the
+// supported providers.
+var providerDefaults = map[string]struct {
+	verifyURL string
+	field     string
+}{
+	providerReCaptcha:   {"https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response"},
+	providerReCaptchaV3: {"https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response"},
+	providerHCaptcha:    {"https://api.hcaptcha.com/siteverify", "h-captcha-response"},
+	providerTurnstile:   {"https://challenges.cloudflare.com/turnstile/v0/siteverify", "cf-turnstile-response"},
+	providerCustom:      {"", ""},
+}
+
+// ReCaptchaResp the response of a siteverify API. reCAPTCHA, hCaptcha and
+// Turnstile share the same format.
+type ReCaptchaResp struct {
+	Success     bool     `json:"success"`
+	ChallengeTs string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+	ErrorCodes  []string `json:"error-codes"`
+	// Score only reCAPTCHA v3: 1.0 is very likely a human, 0.0 a bot.
+	Score float64 `json:"score"`
+	// Action only reCAPTCHA v3: the action name of the challenge.
+	Action string `json:"action"`
+}
+
+// captchaFailure gets returned when the provider or the additional checks
+// reject the response token. All other errors are internal errors.
+type captchaFailure string
+
+func (cf captchaFailure) Error() string {
+	return string(cf)
+}
+
+// siteVerifier implements the siteverify protocol: the secret, the response
+// token and the remote IP get posted to the verify URL which answers with a
+// ReCaptchaResp.
+type siteVerifier struct {
+	name      string
+	verifyURL string
+	field     string
+	secret    string
+	client    *http.Client
+	// hostnames allowed in the response. Empty means the host of the request.
+	// "*" disables the check.
+	hostnames []string
+	// maxAge of the challenge. 0 disables the check.
+	maxAge time.Duration
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+// reCaptchaV3 adds the score and action checks to the siteVerifier.
+type reCaptchaV3 struct {
+	*siteVerifier
+	minScore float64
+	action   string
+}
+
+// newCaptchaProvider creates the captcha provider from the configuration.
+// Returns nil if no provider has been configured.
+func newCaptchaProvider(c *config) (captchaProvider, error) {
+	name, secret := c.captchaProvider, c.captchaSecret
+	if name == "" && c.ReCaptcha {
+		name = providerReCaptcha
+	}
+	if name == "" {
+		return nil, nil
+	}
+	if secret == "" {
+		secret = c.ReCaptchaSecret
+	}
+	def, ok := providerDefaults[name]
+	if !ok {
+		return nil, fmt.Errorf("[mailout] Unknown captcha provider %q", name)
+	}
+	sv := &siteVerifier{
+		name:      name,
+		verifyURL: def.verifyURL,
+		field:     def.field,
+		secret:    secret,
+		client:    c.httpClient,
+		hostnames: c.captchaHostnames,
+		maxAge:    c.captchaMaxAge,
+		now:       time.Now,
+	}
+	if c.captchaVerifyURL != "" {
+		sv.verifyURL = c.captchaVerifyURL
+	}
+	if c.captchaField != "" {
+		sv.field = c.captchaField
+	}
+	if sv.verifyURL == "" || sv.field == "" {
+		return nil, fmt.Errorf("[mailout] Captcha provider %q requires captcha_verify_url and captcha_field", name)
+	}
+	if name == providerReCaptchaV3 {
+		return &reCaptchaV3{
+			siteVerifier: sv,
+			minScore:     c.captchaMinScore,
+			action:       c.captchaAction,
+		}, nil
+	}
+	return sv, nil
+}
+
+// Field returns the name of the form field containing the response token.
+func (sv *siteVerifier) Field() string {
+	return sv.field
+}
+
+// Verify posts the response token to the verify URL.
+func (sv *siteVerifier) Verify(r *http.Request, response string) error {
+	_, err := sv.verify(r, response)
+	return err
+}
+
+// verify posts the response token to the verify URL and checks the success
+// flag, the hostname and the age of the challenge.
+func (sv *siteVerifier) verify(r *http.Request, response string) (*ReCaptchaResp, error) {
+	if response == "" {
+		return nil, captchaFailure("missing-input-response")
+	}
+	resp, err := sv.siteVerify(r, response)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, captchaFailure(strings.Join(resp.ErrorCodes, "; "))
+	}
+	if len(sv.hostnames) > 0 && !sv.isAllowedHostname(resp.Hostname) {
+		return nil, captchaFailure(fmt.Sprintf("hostname %q not allowed", resp.Hostname))
+	}
+	if sv.maxAge > 0 && resp.ChallengeTs != "" {
+		ts, err := time.Parse(time.RFC3339, resp.ChallengeTs)
+		if err != nil {
+			return nil, captchaFailure(fmt.Sprintf("invalid challenge_ts %q", resp.ChallengeTs))
+		}
+		if sv.now().Sub(ts) > sv.maxAge {
+			return nil, captchaFailure("challenge expired")
+		}
+	}
+	return resp, nil
+}
+
+// isAllowedHostname only gets called if hostnames have been configured. The
+// host of the request cannot be used instead, because the form may be embedded
+// on another domain and some providers return an empty hostname.
+func (sv *siteVerifier) isAllowedHostname(hostname string) bool {
+	for _, h := range sv.hostnames {
+		if h == "*" || strings.EqualFold(h, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks additionally the score and the action.
+func (v3 *reCaptchaV3) Verify(r *http.Request, response string) error {
+	resp, err := v3.verify(r, response)
+	if err != nil {
+		return err
+	}
+	if resp.Score < v3.minScore {
+		return captchaFailure(fmt.Sprintf("score %.1f below threshold", resp.Score))
+	}
+	if v3.action != "" && resp.Action != v3.action {
+		return captchaFailure(fmt.Sprintf("unexpected action %q", resp.Action))
+	}
+	return nil
+}
+
+func (sv *siteVerifier) siteVerify(r *http.Request, response string) (*ReCaptchaResp, error) {
+	parts := url.Values{}
+	parts.Set("secret", sv.secret)
+	parts.Set("response", response)
+	parts.Set("remoteip", remoteIP(r))
+	httpResp, err := sv.client.PostForm(sv.verifyURL, parts)
+	if err != nil {
+		return nil, fmt.Errorf("[mailout] %s verification failed: %s", sv.name, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[mailout] %s verification failed with status code %d", sv.name, httpResp.StatusCode)
+	}
+	resp := &ReCaptchaResp{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("[mailout] %s verification response not decodable: %s", sv.name, err)
+	}
+	return resp, nil
+}
+
+// remoteIP returns the IP address of the client without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,225 @@
+package mailout
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+// siteVerifyStubTs challenge time stamp returned by the stub.
+var siteVerifyStubTs = time.Date(2016, 2, 26, 12, 0, 0, 0, time.UTC)
+
+// newSiteVerifyStub starts a local siteverify API which accepts only the
+// response tokens "human", "v3bot", "v3other" and "otherhost" together with
+// the secret "s3cr3t".
+func newSiteVerifyStub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, "192.0.2.1", r.PostFormValue("remoteip"))
+		w.Header().Set(headerContentType, headerApplicationJSONUTF8)
+		ts := siteVerifyStubTs.Format(time.RFC3339)
+		switch {
+		case r.PostFormValue("secret") != "s3cr3t":
+			fmt.Fprint(w, `{"success":false,"error-codes":["invalid-input-secret"]}`)
+		case r.PostFormValue("response") == "human":
+			fmt.Fprintf(w, `{"success":true,"challenge_ts":%q,"hostname":"example.com","score":0.9,"action":"contact"}`, ts)
+		case r.PostFormValue("response") == "v3bot":
+			fmt.Fprintf(w, `{"success":true,"challenge_ts":%q,"hostname":"example.com","score":0.1,"action":"contact"}`, ts)
+		case r.PostFormValue("response") == "v3other":
+			fmt.Fprintf(w, `{"success":true,"challenge_ts":%q,"hostname":"example.com","score":0.9,"action":"login"}`, ts)
+		case r.PostFormValue("response") == "otherhost":
+			fmt.Fprintf(w, `{"success":true,"challenge_ts":%q,"hostname":"evil.example","score":0.9,"action":"contact"}`, ts)
+		default:
+			fmt.Fprint(w, `{"success":false,"error-codes":["invalid-input-response","timeout-or-duplicate"]}`)
+		}
+	}))
+}
+
+func TestNewCaptchaProvider(t *testing.T) {
+
+	tests := []struct {
+		config    string
+		wantURL   string
+		wantField string
+		wantErr   error
+	}{
+		{`mailout`, "", "", nil},
+		{`mailout {
+			recaptcha
+			recaptcha_secret s3cr3t
+		}`, "https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response", nil},
+		{`mailout {
+			captcha_provider recaptcha_v3
+		}`, "https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response", nil},
+		{`mailout {
+			captcha_provider hcaptcha
+		}`, "https://api.hcaptcha.com/siteverify", "h-captcha-response", nil},
+		{`mailout {
+			captcha_provider turnstile
+			captcha_verify_url http://127.0.0.1:8080/verify
+		}`, "http://127.0.0.1:8080/verify", "cf-turnstile-response", nil},
+		{`mailout {
+			captcha_provider custom
+			captcha_verify_url https://captcha.example/siteverify
+			captcha_field my-captcha
+		}`, "https://captcha.example/siteverify", "my-captcha", nil},
+		{`mailout {
+			captcha_provider custom
+		}`, "", "", errors.New("[mailout] Captcha provider \"custom\" requires captcha_verify_url and captcha_field")},
+		{`mailout {
+			captcha_provider funcaptcha
+		}`, "", "", errors.New("[mailout] Unknown captcha provider \"funcaptcha\"")},
+	}
+	for i, test := range tests {
+		mc, err := parse(caddy.NewTestController("http", test.config))
+		if test.wantErr != nil {
+			assert.Nil(t, mc, "Index %d", i)
+			assert.EqualError(t, err, test.wantErr.Error(), "Index %d", i)
+			continue
+		}
+		if err != nil {
+			t.Fatal("Index", i, "Error:", err)
+		}
+		cp, err := newCaptchaProvider(mc)
+		assert.NoError(t, err, "Index %d", i)
+		if test.wantURL == "" {
+			assert.Nil(t, cp, "Index %d", i)
+			continue
+		}
+		sv, ok := cp.(*siteVerifier)
+		if v3, isV3 := cp.(*reCaptchaV3); isV3 {
+			sv, ok = v3.siteVerifier, true
+			assert.Exactly(t, 0.5, v3.minScore, "Index %d", i)
+		}
+		if !ok {
+			t.Fatalf("Index %d: unexpected provider type %T", i, cp)
+		}
+		assert.Exactly(t, test.wantURL, sv.verifyURL, "Index %d", i)
+		assert.Exactly(t, test.wantField, sv.Field(), "Index %d", i)
+		assert.Exactly(t, defaultHTTPClient, sv.client, "Index %d", i)
+	}
+}
+
+func TestSiteVerifier_Verify(t *testing.T) {
+	srv := newSiteVerifyStub(t)
+	defer srv.Close()
+
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+
+	for _, name := range []string{providerReCaptcha, providerReCaptchaV3, providerHCaptcha, providerTurnstile} {
+		cp, err := newCaptchaProvider(&config{
+			captchaProvider:  name,
+			captchaSecret:    "s3cr3t",
+			captchaVerifyURL: srv.URL,
+			httpClient:       &http.Client{},
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		assert.NoError(t, cp.Verify(req, "human"), name)
+		assert.EqualError(t, cp.Verify(req, "bot"), "invalid-input-response; timeout-or-duplicate", name)
+		assert.EqualError(t, cp.Verify(req, ""), "missing-input-response", name)
+		// the hostname only gets checked if captcha_hostname is set
+		assert.NoError(t, cp.Verify(req, "otherhost"), name)
+	}
+
+	cp, err := newCaptchaProvider(&config{
+		captchaProvider:  providerTurnstile,
+		captchaSecret:    "s3cr3t",
+		captchaVerifyURL: srv.URL + "/notfound\x7f",
+		httpClient:       &http.Client{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cp.Verify(req, "human")
+	assert.Error(t, err)
+	_, isFailure := err.(captchaFailure)
+	assert.False(t, isFailure, "transport errors are no captcha failures")
+}
+
+func TestReCaptchaV3_Verify(t *testing.T) {
+	srv := newSiteVerifyStub(t)
+	defer srv.Close()
+
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+
+	tests := []struct {
+		response  string
+		hostnames []string
+		age       time.Duration
+		want      error
+	}{
+		{"human", nil, time.Minute, nil},
+		{"human", nil, time.Minute * 3, captchaFailure("challenge expired")},
+		{"v3bot", nil, time.Minute, captchaFailure("score 0.1 below threshold")},
+		{"v3other", nil, time.Minute, captchaFailure("unexpected action \"login\"")},
+		{"otherhost", nil, time.Minute, nil},
+		{"otherhost", []string{"example.com"}, time.Minute, captchaFailure("hostname \"evil.example\" not allowed")},
+		{"otherhost", []string{"www.example.com", "EVIL.example"}, time.Minute, nil},
+		{"otherhost", []string{"*"}, time.Minute, nil},
+	}
+	for i, test := range tests {
+		cp, err := newCaptchaProvider(&config{
+			captchaProvider:  providerReCaptchaV3,
+			captchaSecret:    "s3cr3t",
+			captchaVerifyURL: srv.URL,
+			captchaHostnames: test.hostnames,
+			captchaMaxAge:    time.Minute * 2,
+			captchaMinScore:  0.5,
+			captchaAction:    "contact",
+			httpClient:       &http.Client{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		age := test.age
+		cp.(*reCaptchaV3).now = func() time.Time { return siteVerifyStubTs.Add(age) }
+		assert.Exactly(t, test.want, cp.Verify(req, test.response), "Index %d", i)
+	}
+}
+
+func TestServeHTTP_CaptchaProvider(t *testing.T) {
+	srv := newSiteVerifyStub(t)
+	defer srv.Close()
+
+	h := newTestHandler(t, `mailout {
+		captcha_provider   hcaptcha
+		captcha_secret     s3cr3t
+		captcha_verify_url `+srv.URL+`
+	}`)
+	// other tests modify the transport of the defaultHTTPClient
+	h.captchaProvider.(*siteVerifier).client = &http.Client{}
+	h.captchaProvider.(*siteVerifier).now = func() time.Time { return siteVerifyStubTs }
+
+	for _, test := range []struct {
+		response string
+		wantCode int
+	}{
+		{"bot", http.StatusForbidden},
+		{"human", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.RemoteAddr = "192.0.2.1:4711"
+		req.PostForm = url.Values{
+			"email":              []string{"ken@thompson.email"},
+			"h-captcha-response": []string{test.response},
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, test.response)
+	}
+}
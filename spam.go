@@ -0,0 +1,298 @@
+package mailout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Types of the spam rules.
+const (
+	spamRuleLinks    = "links"
+	spamRuleWords    = "words"
+	spamRuleRegex    = "regex"
+	spamRuleNonLatin = "non_latin"
+	spamRuleRepeated = "repeated"
+	spamRuleBayes    = "bayes"
+)
+
+// Actions derived from the spam score.
+const (
+	spamActionNone = iota
+	spamActionTag
+	spamActionDrop
+	spamActionReject
+)
+
+const defaultSpamTag = "[SPAM?] "
+
+// linkRegex matches URLs and bare www. host names, one match per link.
+var linkRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// spamRules defines the rule set loaded from a JSON file. Each matching rule
+// adds its score. The sum gets compared with the thresholds. A threshold of 0
+// disables the action.
+type spamRules struct {
+	// Reject rejects the submission with status 422.
+	Reject float64 `json:"reject"`
+	// Drop pretends a successful submission but does not send the email.
+	Drop float64 `json:"drop"`
+	// Tag prefixes the subject with TagPrefix.
+	Tag       float64    `json:"tag"`
+	TagPrefix string     `json:"tag_prefix"`
+	Rules     []spamRule `json:"rules"`
+}
+
+// spamRule a single rule applied to the fields.
+type spamRule struct {
+	Name string `json:"name"`
+	// Type one of links, words, regex, non_latin, repeated or bayes.
+	Type string `json:"type"`
+	// Fields the rule applies to. Empty means all fields.
+	Fields []string `json:"fields"`
+	// Words blocked words, case insensitive. Only for type words.
+	Words []string `json:"words"`
+	// Pattern regular expression. Only for type regex.
+	Pattern string `json:"pattern"`
+	// Max the rule matches if the number of links, the ratio of non Latin
+	// letters, the longest run of the same character or the spam probability
+	// of the Bayes classifier exceeds Max.
+	Max float64 `json:"max"`
+	// Score gets added if the rule matches.
+	Score float64 `json:"score"`
+
+	re    *regexp.Regexp
+	bayes *bayesClassifier
+}
+
+// spamResult contains the score and the names of the matching rules.
+type spamResult struct {
+	Score   float64
+	Matches []string
+	// Bayes spam probability of the Bayes classifier, if a rule uses it.
+	Bayes  float64
+	action int
+}
+
+// ctxKeySpam key to store the spamResult in the request context.
+type ctxKeySpam struct{}
+
+// loadSpamRules parses the JSON file containing the spam rules. bc can be nil
+// if no rule uses the Bayes classifier.
+func loadSpamRules(file string, bc *bayesClassifier) (*spamRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("[mailout] Cannot open spam rules %q: %s", file, err)
+	}
+	defer f.Close()
+
+	sr := &spamRules{}
+	if err := json.NewDecoder(f).Decode(sr); err != nil {
+		return nil, fmt.Errorf("[mailout] Cannot decode spam rules %q: %s", file, err)
+	}
+	if sr.TagPrefix == "" {
+		sr.TagPrefix = defaultSpamTag
+	}
+	for i := range sr.Rules {
+		r := &sr.Rules[i]
+		switch r.Type {
+		case spamRuleLinks, spamRuleNonLatin, spamRuleRepeated:
+		case spamRuleWords:
+			for j, w := range r.Words {
+				r.Words[j] = strings.ToLower(w)
+			}
+		case spamRuleRegex:
+			if r.re, err = regexp.Compile(r.Pattern); err != nil {
+				return nil, fmt.Errorf("[mailout] Spam rule %q in %q: %s", r.Name, file, err)
+			}
+		case spamRuleBayes:
+			if bc == nil {
+				return nil, fmt.Errorf("[mailout] Spam rule %q in %q: requires bayes_ham and bayes_spam", r.Name, file)
+			}
+			r.bayes = bc
+		default:
+			return nil, fmt.Errorf("[mailout] Spam rule %q in %q: unknown type %q", r.Name, file, r.Type)
+		}
+	}
+	return sr, nil
+}
+
+// score applies all rules to the fields and determines the action.
+func (sr *spamRules) score(form map[string][]string, skip []string) spamResult {
+	var res spamResult
+	for _, rule := range sr.Rules {
+		var match bool
+		if rule.Type == spamRuleBayes {
+			res.Bayes = rule.bayes.spamProbability(rule.text(form, skip))
+			match = res.Bayes > rule.Max
+		} else {
+			match = rule.matches(form, skip)
+		}
+		if match {
+			res.Score += rule.Score
+			res.Matches = append(res.Matches, rule.Name)
+		}
+	}
+	switch {
+	case sr.Reject > 0 && res.Score >= sr.Reject:
+		res.action = spamActionReject
+	case sr.Drop > 0 && res.Score >= sr.Drop:
+		res.action = spamActionDrop
+	case sr.Tag > 0 && res.Score >= sr.Tag:
+		res.action = spamActionTag
+	}
+	return res
+}
+
+// matches returns true if one of the fields matches the rule.
+func (rule spamRule) matches(form map[string][]string, skip []string) bool {
+	for field, values := range form {
+		if !rule.appliesTo(field, skip) {
+			continue
+		}
+		for _, v := range values {
+			if rule.matchValue(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// text joins all fields the rule applies to.
+func (rule spamRule) text(form map[string][]string, skip []string) string {
+	var buf strings.Builder
+	for field, values := range form {
+		if !rule.appliesTo(field, skip) {
+			continue
+		}
+		for _, v := range values {
+			buf.WriteString(v)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
+
+func (rule spamRule) appliesTo(field string, skip []string) bool {
+	if len(rule.Fields) == 0 {
+		return !containsString(skip, field)
+	}
+	return containsString(rule.Fields, field)
+}
+
+func (rule spamRule) matchValue(v string) bool {
+	switch rule.Type {
+	case spamRuleLinks:
+		return float64(len(linkRegex.FindAllStringIndex(v, -1))) > rule.Max
+	case spamRuleWords:
+		lv := strings.ToLower(v)
+		for _, w := range rule.Words {
+			if w != "" && containsWord(lv, w) {
+				return true
+			}
+		}
+	case spamRuleRegex:
+		return rule.re.MatchString(v)
+	case spamRuleNonLatin:
+		return nonLatinRatio(v) > rule.Max
+	case spamRuleRepeated:
+		return float64(longestRun(v)) > rule.Max
+	}
+	return false
+}
+
+// nonLatinRatio returns the ratio of letters which are not in the Latin
+// script.
+func nonLatinRatio(s string) float64 {
+	var letters, nonLatin int
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if !unicode.Is(unicode.Latin, r) {
+			nonLatin++
+		}
+	}
+	if letters == 0 {
+		return 0
+	}
+	return float64(nonLatin) / float64(letters)
+}
+
+// containsWord returns true if w occurs in s as a whole word or phrase, so
+// "cialis" does not match "specialist". Word boundaries are only required
+// next to letters and digits of w, so "$$$" matches in "win$$$".
+func containsWord(s, w string) bool {
+	first, _ := utf8.DecodeRuneInString(w)
+	last, _ := utf8.DecodeLastRuneInString(w)
+	for i := 0; i <= len(s)-len(w); {
+		j := strings.Index(s[i:], w)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(w)
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if (!isWordRune(first) || start == 0 || !isWordRune(before)) &&
+			(!isWordRune(last) || end == len(s) || !isWordRune(after)) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		i = start + size
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// longestRun returns the length of the longest sequence of the same
+// character, ignoring white space.
+func longestRun(s string) int {
+	var longest, run int
+	prev := utf8.RuneError
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			run = 0
+		case r == prev:
+			run++
+		default:
+			run = 1
+		}
+		prev = r
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+func containsString(sl []string, s string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withSpamResult stores the result in the context of the request for the
+// mail daemon.
+func withSpamResult(ctx context.Context, res spamResult) context.Context {
+	return context.WithValue(ctx, ctxKeySpam{}, res)
+}
+
+// spamResultFrom returns the spam result of the request, if any.
+func spamResultFrom(ctx context.Context) (spamResult, bool) {
+	res, ok := ctx.Value(ctxKeySpam{}).(spamResult)
+	return res, ok
+}
@@ -0,0 +1,201 @@
+package mailout
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSpamRules(t *testing.T) {
+
+	sr, err := loadSpamRules("testdata/spam_rules.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, 10.0, sr.Reject)
+	assert.Exactly(t, "[SPAM?] ", sr.TagPrefix)
+	assert.Len(t, sr.Rules, 5)
+	assert.Exactly(t, []string{"viagra", "casino", "crypto giveaway"}, sr.Rules[1].Words)
+	assert.NotNil(t, sr.Rules[2].re)
+
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		wantErr string
+	}{
+		{`{"rules":[{"name":"x","type":"unknown"}]}`, "unknown type \"unknown\""},
+		{`{"rules":[{"name":"x","type":"regex","pattern":"("}]}`, "missing closing )"},
+		{`{"rules":`, "Cannot decode spam rules"},
+	}
+	for i, test := range tests {
+		file := filepath.Join(dir, "rules.json")
+		if err := os.WriteFile(file, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadSpamRules(file, nil)
+		assert.Error(t, err, "Index %d", i)
+		if err != nil {
+			assert.Contains(t, err.Error(), test.wantErr, "Index %d", i)
+		}
+	}
+	_, err = loadSpamRules("testdata/not_found.json", nil)
+	assert.Error(t, err)
+}
+
+func TestSpamRules_Score(t *testing.T) {
+
+	sr, err := loadSpamRules("testdata/spam_rules.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		form        url.Values
+		wantScore   float64
+		wantMatches []string
+		wantAction  int
+	}{
+		{url.Values{"message": {"Hello, I would like to order 5 books."}}, 0, nil, spamActionNone},
+		{url.Values{"message": {"see http://a.tld and https://b.tld and www.c.tld"}}, 3, []string{"many_links"}, spamActionTag},
+		// a URL with www. counts as one link
+		{url.Values{"message": {"see https://www.a.tld and http://WWW.b.tld/www.c"}}, 0, nil, spamActionNone},
+		{url.Values{"message": {"see https://www.a.tld, https://www.b.tld and https://www.c.tld"}}, 3, []string{"many_links"}, spamActionTag},
+		{url.Values{"message": {"Cheap VIAGRA at www.a.tld"}}, 4, []string{"blocked_words"}, spamActionTag},
+		{url.Values{"message": {"Please ask our casinoist"}}, 0, nil, spamActionNone},
+		// blocked words only apply to the fields message and name
+		{url.Values{"company": {"Casino Royale Ltd."}}, 0, nil, spamActionNone},
+		{url.Values{"message": {"We offer SEO to rank first on Google", "casino"}}, 7, []string{"blocked_words", "seo_offer"}, spamActionDrop},
+		{url.Values{"message": {"Привет, как дела? Купить дешево"}}, 2, []string{"non_latin"}, spamActionNone},
+		{url.Values{"message": {"Hello!!!!!!!!!!!"}}, 1, []string{"repeated_chars"}, spamActionNone},
+		{url.Values{
+			"message": {"casino http://a http://b http://c SEO rank Google!!!!!!!!"},
+			"name":    {"Виагра"},
+		}, 13, []string{"many_links", "blocked_words", "seo_offer", "non_latin", "repeated_chars"}, spamActionReject},
+		// internal fields get skipped
+		{url.Values{captchaTokenField: {"AAAAAAAAAAAAAAAAAAAAAAAAAAAA"}}, 0, nil, spamActionNone},
+	}
+	for i, test := range tests {
+		res := sr.score(test.form, []string{captchaTokenField})
+		assert.Exactly(t, test.wantScore, res.Score, "Index %d", i)
+		assert.Exactly(t, test.wantMatches, res.Matches, "Index %d", i)
+		assert.Exactly(t, test.wantAction, res.action, "Index %d", i)
+	}
+}
+
+func TestContainsWord(t *testing.T) {
+	tests := []struct {
+		s, w string
+		want bool
+	}{
+		{"cheap cialis now", "cialis", true},
+		{"cialis", "cialis", true},
+		{"cialis!", "cialis", true},
+		{"our specialist calls you", "cialis", false},
+		{"specialist cialis", "cialis", true},
+		{"cialisx", "cialis", false},
+		{"win free money today", "free money", true},
+		{"carefree money", "free money", false},
+		{"купить виагра дешево", "виагра", true},
+		{"виагрань", "виагра", false},
+		{"win$$$", "$$$", true},
+		{"", "cialis", false},
+	}
+	for i, test := range tests {
+		assert.Exactly(t, test.want, containsWord(test.s, test.w), "Index %d", i)
+	}
+}
+
+func TestLongestRunAndNonLatinRatio(t *testing.T) {
+	assert.Exactly(t, 0, longestRun(""))
+	assert.Exactly(t, 3, longestRun("abbbc  dd"))
+	assert.Exactly(t, 2, longestRun("aa    aa"))
+	assert.Exactly(t, 0.0, nonLatinRatio("123 !?"))
+	assert.Exactly(t, 0.5, nonLatinRatio("abДЖ"))
+}
+
+func TestServeHTTP_SpamRules(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		spam_rules testdata/spam_rules.json
+	}`)
+	if err := h.config.loadSpamRules(); err != nil {
+		t.Fatal(err)
+	}
+	pipe := make(chan *http.Request, 1)
+	h.reqPipe = pipe
+
+	tests := []struct {
+		message  string
+		wantCode int
+		wantSent bool
+	}{
+		{"casino http://a http://b http://c SEO rank Google!!!!!!!!", StatusUnprocessableEntity, false},
+		{"We offer SEO to rank first on Google, casino", http.StatusOK, false},
+		{"Cheap viagra", http.StatusOK, true},
+		{"Hello", http.StatusOK, true},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{
+			"email":   {"ken@thompson.email"},
+			"message": {test.message},
+		}
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		if test.wantSent {
+			assert.Len(t, pipe, 1, "Index %d", i)
+			r := <-pipe
+			_, ok := spamResultFrom(r.Context())
+			assert.True(t, ok, "Index %d", i)
+		} else {
+			assert.Len(t, pipe, 0, "Index %d", i)
+		}
+	}
+}
+
+func TestMessageSpamTaggedSubject(t *testing.T) {
+
+	mc, err := parse(caddy.NewTestController("http", `mailout {
+		to         gopher@domain.email
+		subject    "Email from {{.Form.Get \"name\"}}"
+		body       testdata/mail_plainTextMessage.txt
+		spam_rules testdata/spam_rules.json
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadSpamRules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadPGPKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = url.Values{
+		"email":   {"ken@thompson.email"},
+		"name":    {"Ken"},
+		"message": {"Cheap viagra"},
+	}
+	res := mc.spamRules.score(req.PostForm, nil)
+	req = req.WithContext(withSpamResult(req.Context(), res))
+
+	buf := new(bytes.Buffer)
+	if _, err := newMessage(mc, req).build().WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "Subject: [SPAM?] Email from Ken")
+}
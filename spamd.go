@@ -0,0 +1,190 @@
+package mailout
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SchumacherFM/mailout/bufpool"
+)
+
+const (
+	spamdVersion     = "SPAMC/1.5"
+	headerSpamScore  = "X-Spam-Score"
+	headerSpamStatus = "X-Spam-Status"
+)
+
+// spamdClient talks the SPAMC protocol to a SpamAssassin spamd daemon via TCP
+// or a Unix socket.
+type spamdClient struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// spamdResult the verdict of spamd.
+type spamdResult struct {
+	IsSpam    bool
+	Score     float64
+	Threshold float64
+}
+
+// newSpamdClient creates a new client. See socketAddr for the address format.
+func newSpamdClient(addr string, timeout time.Duration) *spamdClient {
+	sc := &spamdClient{
+		timeout: timeout,
+	}
+	sc.network, sc.addr = socketAddr(addr)
+	return sc
+}
+
+// socketAddr returns the network of a daemon address. Addresses starting with
+// unix: or a slash denote a Unix socket, all others host:port.
+func socketAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", addr[len("unix:"):]
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// check sends the message to spamd with the CHECK command and parses the
+// returned score.
+func (sc *spamdClient) check(msg io.WriterTo) (res spamdResult, err error) {
+	body := bufpool.Get()
+	defer bufpool.Put(body)
+	if _, err = msg.WriteTo(body); err != nil {
+		return
+	}
+
+	conn, err := net.DialTimeout(sc.network, sc.addr, sc.timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(sc.timeout)); err != nil {
+		return
+	}
+
+	if _, err = fmt.Fprintf(conn, "CHECK %s\r\nContent-length: %d\r\n\r\n", spamdVersion, body.Len()); err != nil {
+		return
+	}
+	if _, err = conn.Write(body.Bytes()); err != nil {
+		return
+	}
+	// signals spamd the end of the message
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		if err = cw.CloseWrite(); err != nil {
+			return
+		}
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parseSpamdResponse parses e.g.:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Spam: True ; 15.0 / 5.0
+func parseSpamdResponse(r *bufio.Reader) (res spamdResult, err error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return res, fmt.Errorf("spamd: cannot read response: %s", err)
+	}
+	parts := strings.Fields(status)
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return res, fmt.Errorf("spamd: malformed response %q", strings.TrimSpace(status))
+	}
+	if parts[1] != "0" {
+		return res, fmt.Errorf("spamd: error response %q", strings.TrimSpace(status))
+	}
+
+	for {
+		line, errR := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(line[:i], "Spam") {
+			return parseSpamdSpamHeader(line[i+1:])
+		}
+		if errR != nil {
+			break
+		}
+	}
+	return res, errors.New("spamd: response does not contain a Spam header")
+}
+
+// parseSpamdSpamHeader parses the value of the Spam header: True ; 15.0 / 5.0
+func parseSpamdSpamHeader(v string) (res spamdResult, err error) {
+	i := strings.IndexByte(v, ';')
+	j := strings.IndexByte(v, '/')
+	if i < 0 || j < i {
+		return res, fmt.Errorf("spamd: malformed Spam header %q", v)
+	}
+	verdict := strings.TrimSpace(v[:i])
+	res.IsSpam = strings.EqualFold(verdict, "True") || strings.EqualFold(verdict, "Yes")
+	if res.Score, err = strconv.ParseFloat(strings.TrimSpace(v[i+1:j]), 64); err != nil {
+		return res, fmt.Errorf("spamd: malformed score in %q: %s", v, err)
+	}
+	if res.Threshold, err = strconv.ParseFloat(strings.TrimSpace(v[j+1:]), 64); err != nil {
+		return res, fmt.Errorf("spamd: malformed threshold in %q: %s", v, err)
+	}
+	return res, nil
+}
+
+// status returns the value of the X-Spam-Status header.
+func (res spamdResult) status(tag bool) string {
+	verdict := "No"
+	if tag {
+		verdict = "Yes"
+	}
+	return fmt.Sprintf("%s, score=%.1f required=%.1f", verdict, res.Score, res.Threshold)
+}
+
+// spamdCheck scans an unencrypted copy of the email with spamd, adds the
+// X-Spam headers to the messages and tags their subject. Returns false if the
+// messages must not be sent. If spamd cannot be reached the messages get sent
+// unchanged.
+func spamdCheck(mc *config, bm message, mails messages) bool {
+	if mc.spamdAddr == "" || len(mails) == 0 {
+		return true
+	}
+
+	// the messages to PGP recipients contain only ciphertext, so spamd gets
+	// a copy with the rendered body.
+	res, err := newSpamdClient(mc.spamdAddr, mc.spamdTimeout).check(bm.plainCopy())
+	if err != nil {
+		mc.maillog.Errorf("[mailout] %s", err)
+		return true
+	}
+
+	tag := res.IsSpam
+	if mc.spamdTag > 0 {
+		tag = res.Score >= mc.spamdTag
+	}
+	if mc.spamdReject > 0 && res.Score >= mc.spamdReject {
+		mc.maillog.Errorf("[mailout] spamd rejected message. Score %.1f Threshold %.1f", res.Score, mc.spamdReject)
+		return false
+	}
+
+	for _, m := range mails {
+		m.SetHeader(headerSpamScore, strconv.FormatFloat(res.Score, 'f', 1, 64))
+		m.SetHeader(headerSpamStatus, res.status(tag))
+		if tag {
+			if s := m.GetHeader("Subject"); len(s) > 0 && !strings.HasPrefix(s[0], mc.spamTagPrefix()) {
+				m.SetHeader("Subject", mc.spamTagPrefix()+s[0])
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+package mailout
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+// fakeSpamd accepts SPAMC CHECK requests and answers with the response
+// returned by score. received contains the last scanned message.
+type fakeSpamd struct {
+	ln       net.Listener
+	received chan string
+	score    func(msg string) string
+}
+
+func newFakeSpamd(t *testing.T, network, addr string, score func(msg string) string) *fakeSpamd {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSpamd{
+		ln:       ln,
+		received: make(chan string, 10),
+		score:    score,
+	}
+	go fs.serve()
+	return fs
+}
+
+func (fs *fakeSpamd) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeSpamd) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	cmd, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(cmd, "CHECK SPAMC/") {
+		io.WriteString(conn, "SPAMD/1.1 76 Bad header line\r\n")
+		return
+	}
+	length := -1
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-length:") {
+			length, _ = strconv.Atoi(strings.TrimSpace(line[len("Content-length:"):]))
+		}
+	}
+	body, err := io.ReadAll(br)
+	if err != nil || len(body) != length {
+		io.WriteString(conn, "SPAMD/1.1 76 Bad header line\r\n")
+		return
+	}
+	fs.received <- string(body)
+	io.WriteString(conn, fs.score(string(body)))
+}
+
+func (fs *fakeSpamd) Close() error { return fs.ln.Close() }
+
+// spamdScoreByWords returns a high score if the message contains viagra.
+func spamdScoreByWords(msg string) string {
+	if strings.Contains(msg, "viagra") {
+		return "SPAMD/1.1 0 EX_OK\r\nSpam: True ; 16.2 / 5.0\r\n\r\n"
+	}
+	if strings.Contains(msg, "casino") {
+		return "SPAMD/1.1 0 EX_OK\r\nSpam: True ; 7.0 / 5.0\r\n\r\n"
+	}
+	return "SPAMD/1.1 0 EX_OK\r\nSpam: False ; 1.3 / 5.0\r\n\r\n"
+}
+
+func TestSpamdClient_Check(t *testing.T) {
+
+	tcp := newFakeSpamd(t, "tcp", "127.0.0.1:0", spamdScoreByWords)
+	defer tcp.Close()
+	sock := filepath.Join(t.TempDir(), "spamd.sock")
+	unix := newFakeSpamd(t, "unix", sock, spamdScoreByWords)
+	defer unix.Close()
+
+	tests := []struct {
+		addr    string
+		msg     string
+		wantRes spamdResult
+	}{
+		{tcp.ln.Addr().String(), "buy viagra", spamdResult{IsSpam: true, Score: 16.2, Threshold: 5}},
+		{tcp.ln.Addr().String(), "hello", spamdResult{IsSpam: false, Score: 1.3, Threshold: 5}},
+		{"unix:" + sock, "buy viagra", spamdResult{IsSpam: true, Score: 16.2, Threshold: 5}},
+		{sock, "hello", spamdResult{IsSpam: false, Score: 1.3, Threshold: 5}},
+	}
+	for i, test := range tests {
+		res, err := newSpamdClient(test.addr, time.Second).check(bytes.NewBufferString(test.msg))
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantRes, res, "Index %d", i)
+	}
+	assert.Exactly(t, "buy viagra", <-tcp.received)
+}
+
+func TestParseSpamdResponse(t *testing.T) {
+	tests := []struct {
+		resp    string
+		wantRes spamdResult
+		wantErr string
+	}{
+		{"SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: Yes ; -0.5 / 5.0\r\n\r\n", spamdResult{IsSpam: true, Score: -0.5, Threshold: 5}, ""},
+		{"SPAMD/1.1 76 Bad header line: XXX\r\n", spamdResult{}, "spamd: error response"},
+		{"HTTP/1.1 200 OK\r\n\r\n", spamdResult{}, "spamd: malformed response"},
+		{"SPAMD/1.1 0 EX_OK\r\n\r\n", spamdResult{}, "does not contain a Spam header"},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True 15.0\r\n\r\n", spamdResult{}, "malformed Spam header"},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True ; x / 5.0\r\n\r\n", spamdResult{}, "malformed score"},
+		{"", spamdResult{}, "cannot read response"},
+	}
+	for i, test := range tests {
+		res, err := parseSpamdResponse(bufio.NewReader(strings.NewReader(test.resp)))
+		if test.wantErr != "" {
+			assert.Error(t, err, "Index %d", i)
+			if err != nil {
+				assert.Contains(t, err.Error(), test.wantErr, "Index %d", i)
+			}
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantRes, res, "Index %d", i)
+	}
+}
+
+func TestSpamdCheck(t *testing.T) {
+
+	fs := newFakeSpamd(t, "tcp", "127.0.0.1:0", spamdScoreByWords)
+	defer fs.Close()
+
+	tests := []struct {
+		config      string
+		firstname   string
+		wantSend    bool
+		wantScore   string
+		wantStatus  string
+		wantSubject string
+	}{
+		{"", "Hello", true, "1.3", "No, score=1.3 required=5.0", "Email from Ken"},
+		{"", "Cheap casino", true, "7.0", "Yes, score=7.0 required=5.0", "[SPAM?] Email from Ken"},
+		{"spamd_tag 10", "Cheap casino", true, "7.0", "No, score=7.0 required=5.0", "Email from Ken"},
+		{"spamd_reject 15", "Cheap viagra", false, "", "", ""},
+		{"spamd_reject 15", "Cheap casino", true, "7.0", "Yes, score=7.0 required=5.0", "[SPAM?] Email from Ken"},
+	}
+	for i, test := range tests {
+		mc, err := parse(caddy.NewTestController("http", `mailout {
+			to      gopher@domain.email
+			subject "Email from {{.Form.Get \"name\"}}"
+			body    testdata/mail_plainTextMessage.txt
+			spamd   `+fs.ln.Addr().String()+`
+			`+test.config+`
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.loadTemplate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.loadPGPKeys(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/mailout", nil)
+		req.PostForm = url.Values{
+			"email":     {"ken@thompson.email"},
+			"name":      {"Ken"},
+			"firstname": {test.firstname},
+		}
+		bm := newMessage(mc, req)
+		mails := bm.build()
+
+		assert.Exactly(t, test.wantSend, spamdCheck(mc, bm, mails), "Index %d", i)
+		assert.Contains(t, <-fs.received, "Subject: Email from Ken", "Index %d", i)
+		if !test.wantSend {
+			continue
+		}
+		assert.Exactly(t, []string{test.wantScore}, mails[0].GetHeader(headerSpamScore), "Index %d", i)
+		assert.Exactly(t, []string{test.wantStatus}, mails[0].GetHeader(headerSpamStatus), "Index %d", i)
+		assert.Exactly(t, []string{test.wantSubject}, mails[0].GetHeader("Subject"), "Index %d", i)
+	}
+}
+
+func TestSpamdCheck_PGPOnly(t *testing.T) {
+
+	fs := newFakeSpamd(t, "tcp", "127.0.0.1:0", spamdScoreByWords)
+	defer fs.Close()
+
+	mc, err := parse(caddy.NewTestController("http", `mailout {
+		subject          "Email from {{.Form.Get \"name\"}}"
+		body             testdata/mail_plainTextMessage.txt
+		spamd            `+fs.ln.Addr().String()+`
+		pgp@domain.email testdata/B06469EE_nopw.pub.asc
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadPGPKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = url.Values{
+		"email":     {"ken@thompson.email"},
+		"name":      {"Ken"},
+		"firstname": {"Cheap casino"},
+	}
+	bm := newMessage(mc, req)
+	mails := bm.build()
+	assert.Len(t, mails, 1)
+
+	// spamd scores the plain text, not the ciphertext
+	assert.True(t, spamdCheck(mc, bm, mails))
+	received := <-fs.received
+	assert.Contains(t, received, "To: pgp@domain.email")
+	assert.Contains(t, received, "Cheap casino")
+	assert.Exactly(t, []string{"Yes, score=7.0 required=5.0"}, mails[0].GetHeader(headerSpamStatus))
+	assert.Exactly(t, []string{"[SPAM?] Email from Ken"}, mails[0].GetHeader("Subject"))
+}
+
+func TestSpamdCheck_Unreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	mc := newConfig()
+	mc.spamdAddr = addr
+	mc.spamdTimeout = time.Second
+	mc.body = "testdata/mail_plainTextMessage.txt"
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("Subject", "Hello")
+
+	// fails open: the message gets sent unchanged
+	req := httptest.NewRequest("POST", "/mailout", nil)
+	req.PostForm = url.Values{"email": {"ken@thompson.email"}}
+	assert.True(t, spamdCheck(mc, newMessage(mc, req), messages{m}))
+	assert.Empty(t, m.GetHeader(headerSpamScore))
+	assert.Exactly(t, []string{"Hello"}, m.GetHeader("Subject"))
+}
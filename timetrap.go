@@ -0,0 +1,82 @@
+package mailout
+
+import (
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeTrapField form field name which must contain the token issued by the
+// route {endpoint}/token.
+const timeTrapField = "timetrap_token"
+
+var (
+	errTimeTrapMissing = errors.New("Missing time trap token")
+	errTimeTrapInvalid = errors.New("Invalid time trap token")
+	errTimeTrapTooFast = errors.New("Form submitted too fast")
+	errTimeTrapExpired = errors.New("Time trap token expired")
+)
+
+// timeTrap issues and verifies HMAC signed tokens containing the time when a
+// form has been loaded. Bots usually submit a form within milliseconds.
+type timeTrap struct {
+	key    []byte
+	minAge time.Duration
+	maxAge time.Duration
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+// newTimeTrap creates a new time trap. An empty secret generates a random key
+// which is only valid for the lifetime of the process.
+func newTimeTrap(secret string, minAge, maxAge time.Duration) timeTrap {
+	key := []byte(secret)
+	if secret == "" {
+		key = randomKey(32)
+	}
+	return timeTrap{
+		key:    key,
+		minAge: minAge,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+// issue creates a new token for the current time.
+func (tt timeTrap) issue() string {
+	ts := strconv.FormatInt(tt.now().UnixNano(), 36)
+	return ts + "." + tt.sign(ts)
+}
+
+// verify checks the signature and the age of the token.
+func (tt timeTrap) verify(token string) error {
+	if token == "" {
+		return errTimeTrapMissing
+	}
+	pos := strings.IndexByte(token, '.')
+	if pos < 1 {
+		return errTimeTrapInvalid
+	}
+	ts, sig := token[:pos], token[pos+1:]
+	if !hmac.Equal([]byte(sig), []byte(tt.sign(ts))) {
+		return errTimeTrapInvalid
+	}
+	issued, err := strconv.ParseInt(ts, 36, 64)
+	if err != nil {
+		return errTimeTrapInvalid
+	}
+	age := tt.now().Sub(time.Unix(0, issued))
+	if age < tt.minAge {
+		return errTimeTrapTooFast
+	}
+	if tt.maxAge > 0 && age > tt.maxAge {
+		return errTimeTrapExpired
+	}
+	return nil
+}
+
+func (tt timeTrap) sign(ts string) string {
+	return hmacSign(tt.key, ts)
+}
@@ -0,0 +1,47 @@
+package mailout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeTrap(t *testing.T) {
+
+	now := time.Date(2016, 2, 26, 12, 0, 0, 0, time.UTC)
+	tt := newTimeTrap("s3cr3t", time.Second*3, time.Hour)
+	tt.now = func() time.Time { return now }
+	token := tt.issue()
+
+	tests := []struct {
+		token string
+		age   time.Duration
+		want  error
+	}{
+		{"", time.Second * 10, errTimeTrapMissing},
+		{"garbage", time.Second * 10, errTimeTrapInvalid},
+		{token + "x", time.Second * 10, errTimeTrapInvalid},
+		{"1" + token, time.Second * 10, errTimeTrapInvalid},
+		{token, time.Millisecond * 30, errTimeTrapTooFast},
+		{token, time.Hour * 2, errTimeTrapExpired},
+		{token, time.Second * 10, nil},
+	}
+	for i, test := range tests {
+		tt.now = func() time.Time { return now.Add(test.age) }
+		assert.Exactly(t, test.want, tt.verify(test.token), "Index %d", i)
+	}
+
+	other := newTimeTrap("an0th3r", time.Second*3, time.Hour)
+	other.now = tt.now
+	assert.Exactly(t, errTimeTrapInvalid, other.verify(token))
+}
+
+func TestTimeTrap_RandomKey(t *testing.T) {
+	tt1 := newTimeTrap("", 0, 0)
+	tt2 := newTimeTrap("", 0, 0)
+	assert.Len(t, tt1.key, 32)
+	assert.NotEqual(t, tt1.key, tt2.key)
+	assert.NoError(t, tt1.verify(tt1.issue()))
+	assert.Exactly(t, errTimeTrapInvalid, tt2.verify(tt1.issue()))
+}
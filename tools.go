@@ -1,10 +1,52 @@
 package mailout
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
+// splitList splits the arguments additionally by comma and removes empty
+// entries.
+func splitList(args []string) []string {
+	var ret []string
+	for _, a := range args {
+		for _, e := range strings.Split(a, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				ret = append(ret, e)
+			}
+		}
+	}
+	return ret
+}
+
+// parseByteSize parses a size in bytes with an optional unit KB, MB or GB,
+// e.g. 512KB. Units are multiples of 1024.
+func parseByteSize(s string) (int64, error) {
+	u := strings.ToUpper(strings.TrimSpace(s))
+	mul := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(u, unit.suffix) {
+			u, mul = strings.TrimSpace(strings.TrimSuffix(u, unit.suffix)), unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("[mailout] Invalid size %q", s)
+	}
+	return n * mul, nil
+}
+
 // fileExists returns true if file exists
 func fileExists(path string) bool {
 	fi, err := os.Stat(path)
@@ -39,3 +81,19 @@ func deleteEntrySS(sl []string, toDelete string) []string {
 	}
 	return ret
 }
+
+// randomKey returns n random bytes and panics if the random source fails.
+func randomKey(n int) []byte {
+	k := make([]byte, n)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// hmacSign returns the URL safe base64 encoded HMAC-SHA256 of data.
+func hmacSign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
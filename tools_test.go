@@ -22,3 +22,29 @@ func TestIsValidEmail(t *testing.T) {
 		assert.Exactly(t, isValidEmail(test.have), test.want, test.have)
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+
+	tests := []struct {
+		have    string
+		want    int64
+		wantErr string
+	}{
+		{"1024", 1024, ""},
+		{"512KB", 512 << 10, ""},
+		{"5 MB", 5 << 20, ""},
+		{"1gb", 1 << 30, ""},
+		{"100B", 100, ""},
+		{"-1", 0, `[mailout] Invalid size "-1"`},
+		{"MB", 0, `[mailout] Invalid size "MB"`},
+	}
+	for i, test := range tests {
+		have, err := parseByteSize(test.have)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.want, have, "Index %d", i)
+	}
+}
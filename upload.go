@@ -0,0 +1,200 @@
+package mailout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+// sniffLen number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// ctxKeyUploads key to store the accepted files in the request context.
+type ctxKeyUploads struct{}
+
+// upload an accepted file of a multipart request.
+type upload struct {
+	field string
+	name  string
+	// contentType detected by sniffing the content.
+	contentType string
+	data        []byte
+}
+
+// uploadError rejects a file upload with an HTTP status code.
+type uploadError struct {
+	status int
+	field  string
+	codedError
+}
+
+func newUploadError(status int, field, code, format string, a ...interface{}) uploadError {
+	return uploadError{status: status, field: field, codedError: codedError{code, fmt.Sprintf(format, a...)}}
+}
+
+func (ue uploadError) jsonError() JSONError {
+	je := JSONError{
+		Code:      ue.status,
+		Error:     ue.msg,
+		ErrorCode: ue.code,
+	}
+	if ue.field != "" {
+		je.Fields = map[string][]string{ue.field: {ue.msg}}
+	}
+	return je
+}
+
+// isMultipartRequest returns true if the body has the content type
+// multipart/form-data.
+func isMultipartRequest(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get(headerContentType))
+	return err == nil && mt == "multipart/form-data"
+}
+
+// parseUploads parses a multipart body and checks the files against the
+// limits of the configuration. The body may contain maxBodySize bytes for the
+// form values and the part headers in addition to the files. Accepted files
+// are read into memory, because the temporary files get removed before the
+// email daemon sends the messages. Errors are of type uploadError.
+func parseUploads(mc *config, w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, mc.uploadMaxTotalSize+mc.maxBodySize)
+	if err := r.ParseMultipartForm(mc.uploadMaxTotalSize); err != nil {
+		if isBodyTooLarge(err) {
+			return r, newUploadError(http.StatusRequestEntityTooLarge, "", errCodePayloadTooLarge, "Request body too large")
+		}
+		return r, newUploadError(http.StatusBadRequest, "", errCodeBadRequest, "%s", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var ups []upload
+	var total int64
+	for _, field := range fields {
+		for _, fh := range r.MultipartForm.File[field] {
+			if fh.Filename == "" && fh.Size == 0 {
+				continue // empty file input
+			}
+			if mc.uploadMaxFiles == 0 {
+				return r, newUploadError(StatusUnprocessableEntity, field, errCodeTooManyFiles, "File uploads not allowed")
+			}
+			if len(ups) >= mc.uploadMaxFiles {
+				return r, newUploadError(StatusUnprocessableEntity, field, errCodeTooManyFiles, "Too many files, maximum %d", mc.uploadMaxFiles)
+			}
+			if fh.Size > mc.uploadMaxFileSize {
+				return r, newUploadError(http.StatusRequestEntityTooLarge, field, errCodeFileTooLarge, "File %q too large, maximum %d bytes", fh.Filename, mc.uploadMaxFileSize)
+			}
+			if total += fh.Size; total > mc.uploadMaxTotalSize {
+				return r, newUploadError(http.StatusRequestEntityTooLarge, field, errCodeFileTooLarge, "Files too large, maximum %d bytes in total", mc.uploadMaxTotalSize)
+			}
+
+			data, err := readUpload(fh)
+			if err != nil {
+				return r, newUploadError(http.StatusBadRequest, field, errCodeBadRequest, "Cannot read file %q: %s", fh.Filename, err)
+			}
+			ct := sniffContentType(data)
+			if !mc.uploadTypeAllowed(ct) {
+				return r, newUploadError(StatusUnprocessableEntity, field, errCodeFileType, "File type %q of %q not allowed", ct, fh.Filename)
+			}
+			ups = append(ups, upload{
+				field:       field,
+				name:        uploadFileName(fh.Filename),
+				contentType: ct,
+				data:        data,
+			})
+		}
+	}
+	if len(ups) == 0 {
+		return r, nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyUploads{}, ups)), nil
+}
+
+func readUpload(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// sniffContentType detects the media type without parameters.
+func sniffContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mt
+}
+
+// uploadTypeAllowed returns true if the media type matches one of the
+// configured types. A type can end with /* to match all subtypes.
+func (c *config) uploadTypeAllowed(contentType string) bool {
+	for _, t := range c.uploadTypes {
+		if t == contentType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFileName removes the path and characters which break the MIME
+// headers from the name provided by the client.
+func uploadFileName(name string) string {
+	name = filepath.Base(strings.Replace(name, `\`, "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "attachment"
+	}
+	return name
+}
+
+// uploadsFrom returns the accepted files of the request.
+func uploadsFrom(ctx context.Context) []upload {
+	ups, _ := ctx.Value(ctxKeyUploads{}).([]upload)
+	return ups
+}
+
+// mimeHeaders returns the Content-Type and Content-Disposition of the
+// attachment.
+func (u upload) mimeHeaders() map[string][]string {
+	return map[string][]string{
+		"Content-Type":        {mime.FormatMediaType(u.contentType, map[string]string{"name": u.name})},
+		"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": u.name})},
+	}
+}
+
+// attachUploads adds the files to an unencrypted message.
+func attachUploads(gm *gomail.Message, ups []upload) {
+	for _, u := range ups {
+		data := u.data
+		gm.Attach(u.name,
+			gomail.SetHeader(u.mimeHeaders()),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		)
+	}
+}
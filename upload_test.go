@@ -0,0 +1,239 @@
+package mailout
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testPDF = []byte("%PDF-1.4\n% curriculum vitae of Ken Thompson\n")
+	testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	testEXE = []byte("MZ\x90\x00\x03\x00\x00\x00")
+)
+
+type testFile struct {
+	field, name string
+	data        []byte
+}
+
+func newMultipartRequest(t *testing.T, values map[string]string, files ...testFile) *http.Request {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range values {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		fw, err := mw.CreateFormFile(f.field, f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/mailout", body)
+	req.Header.Set(headerContentType, mw.FormDataContentType())
+	return req
+}
+
+func TestParseUploads(t *testing.T) {
+	mc := newConfig()
+	mc.uploadMaxFiles = 2
+	mc.uploadMaxFileSize = 100
+	mc.uploadMaxTotalSize = 150
+
+	tests := []struct {
+		files      []testFile
+		wantStatus int
+		wantCode   string
+		wantErr    string
+		wantTypes  []string
+	}{
+		{nil, 0, "", "", nil},
+		{[]testFile{{"cv", "", nil}}, 0, "", "", nil},
+		{[]testFile{{"cv", `C:\Users\ken\cv.pdf`, testPDF}, {"photo", "ken.png", testPNG}}, 0, "", "", []string{"application/pdf", "image/png"}},
+		{[]testFile{{"cv", "cv.pdf", testEXE}}, StatusUnprocessableEntity, errCodeFileType, `File type "application/octet-stream" of "cv.pdf" not allowed`, nil},
+		{[]testFile{{"cv", "a.pdf", testPDF}, {"cv", "b.pdf", testPDF}, {"cv", "c.pdf", testPDF}}, StatusUnprocessableEntity, errCodeTooManyFiles, "Too many files, maximum 2", nil},
+		{[]testFile{{"cv", "cv.pdf", bytes.Repeat(testPDF, 3)}}, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, `File "cv.pdf" too large, maximum 100 bytes`, nil},
+		{[]testFile{{"cv", "a.pdf", bytes.Repeat(testPDF, 2)}, {"photo", "b.pdf", bytes.Repeat(testPDF, 2)}}, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, "Files too large, maximum 150 bytes in total", nil},
+	}
+	for i, test := range tests {
+		req := newMultipartRequest(t, map[string]string{"email": "ken@thompson.email"}, test.files...)
+		assert.True(t, isMultipartRequest(req), "Index %d", i)
+
+		req, err := parseUploads(mc, httptest.NewRecorder(), req)
+		if test.wantErr != "" {
+			ue, ok := err.(uploadError)
+			assert.True(t, ok, "Index %d", i)
+			assert.Exactly(t, test.wantStatus, ue.status, "Index %d", i)
+			assert.Exactly(t, test.wantCode, ue.code, "Index %d", i)
+			assert.EqualError(t, err, test.wantErr, "Index %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, "ken@thompson.email", req.PostFormValue("email"), "Index %d", i)
+		var types []string
+		for _, u := range uploadsFrom(req.Context()) {
+			types = append(types, u.contentType)
+		}
+		assert.Exactly(t, test.wantTypes, types, "Index %d", i)
+	}
+}
+
+func TestParseUploads_Disabled(t *testing.T) {
+	req := newMultipartRequest(t, nil, testFile{"cv", "cv.pdf", testPDF})
+	_, err := parseUploads(newConfig(), httptest.NewRecorder(), req)
+	assert.EqualError(t, err, "File uploads not allowed")
+}
+
+func TestParseUploads_BodyTooLarge(t *testing.T) {
+	mc := newConfig()
+	mc.uploadMaxFiles = 1
+	mc.uploadMaxTotalSize = 10
+	mc.maxBodySize = 100
+	req := newMultipartRequest(t, nil, testFile{"cv", "cv.pdf", bytes.Repeat(testPDF, 3)})
+	_, err := parseUploads(mc, httptest.NewRecorder(), req)
+	assert.Exactly(t, http.StatusRequestEntityTooLarge, err.(uploadError).status)
+	assert.Exactly(t, errCodePayloadTooLarge, err.(uploadError).code)
+}
+
+func TestUploadTypeAllowed(t *testing.T) {
+	mc := newConfig()
+	mc.uploadTypes = []string{"application/pdf", "image/*"}
+	assert.True(t, mc.uploadTypeAllowed("application/pdf"))
+	assert.True(t, mc.uploadTypeAllowed("image/webp"))
+	assert.False(t, mc.uploadTypeAllowed("application/zip"))
+	assert.False(t, mc.uploadTypeAllowed("imagex/png"))
+}
+
+func TestUploadFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"cv.pdf", "cv.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\ken\cv.pdf`, "cv.pdf"},
+		{"c\"v\r\n.pdf", "cv.pdf"},
+		{"", "attachment"},
+		{"..", "attachment"},
+	}
+	for i, test := range tests {
+		assert.Exactly(t, test.want, uploadFileName(test.name), "Index %d", i)
+	}
+}
+
+func TestServeHTTP_Uploads(t *testing.T) {
+
+	h := newTestHandler(t, `mailout {
+		upload_max_files 1
+	}`)
+
+	tests := []struct {
+		files    []testFile
+		wantCode int
+		wantBody string
+	}{
+		{[]testFile{{"cv", "cv.pdf", testPDF}}, http.StatusOK, `{"version":2,"code":200}`},
+		{[]testFile{{"cv", "cv.exe", testEXE}}, StatusUnprocessableEntity, `{"version":2,"code":422,"error":"File type \"application/octet-stream\" of \"cv.exe\" not allowed","error_code":"file_type_not_allowed","fields":{"cv":["File type \"application/octet-stream\" of \"cv.exe\" not allowed"]}}`},
+	}
+	for i, test := range tests {
+		req := newMultipartRequest(t, map[string]string{"email": "ken@thompson.email"}, test.files...)
+		req.Header.Set("Accept", headerApplicationJSONV2)
+		w := httptest.NewRecorder()
+		_, err := h.ServeHTTP(w, req)
+		assert.NoError(t, err, "Index %d", i)
+		assert.Exactly(t, test.wantCode, w.Code, "Index %d", i)
+		assert.Exactly(t, test.wantBody+"\n", w.Body.String(), "Index %d", i)
+	}
+}
+
+func TestMessage_Uploads(t *testing.T) {
+
+	c := caddy.NewTestController("http", `mailout {
+		to                upload@domain.email
+		body              testdata/mail_plainTextMessage.txt
+		upload_max_files  2
+	}`)
+	mc, err := parse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.loadPGPKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newMultipartRequest(t, map[string]string{"email": "ken@thompson.email"}, testFile{"cv", "cv.pdf", testPDF})
+	req, err = parseUploads(mc, httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := newMessage(mc, req).build().WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "Content-Type: multipart/mixed;")
+	assert.Contains(t, buf.String(), `Content-Type: application/pdf; name=cv.pdf`)
+	assert.Contains(t, buf.String(), `Content-Disposition: attachment; filename=cv.pdf`)
+	assert.Contains(t, buf.String(), "JVBERi0xLjQKJSBjdXJyaWN1bHVtIHZpdGFl") // base64 of testPDF
+}
+
+func TestMessage_RenderEncryptedContent(t *testing.T) {
+	mc := newConfig()
+	mc.body = "testdata/mail_plainTextMessage.txt"
+	if err := mc.loadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	mc.uploadMaxFiles = 2
+
+	req := newMultipartRequest(t, map[string]string{"email": "ken@thompson.email"},
+		testFile{"cv", "cv.pdf", testPDF}, testFile{"photo", "ken.png", testPNG})
+	req, err := parseUploads(mc, httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	newMessage(mc, req).renderEncryptedContent(buf)
+
+	header, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	mt, params, err := mime.ParseMediaType(strings.TrimPrefix(header, "Content-Type: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Exactly(t, "multipart/mixed", mt)
+
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+" "+p.FileName())
+		if p.FileName() == "" {
+			assert.Contains(t, string(data), "Email ken@thompson.email")
+		}
+	}
+	assert.Exactly(t, []string{"text/plain; charset=UTF-8 ", "application/pdf; name=cv.pdf cv.pdf", "image/png; name=ken.png ken.png"}, parts)
+}